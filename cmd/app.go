@@ -0,0 +1,238 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// appUnitPrefix is the name prefix of the systemd units of the apps.
+	appUnitPrefix = "ignite-cntr-app-"
+	// systemdUnitDir is the directory of the app units in the VM image.
+	systemdUnitDir = "etc/systemd/system"
+	// appUnitWantedBy is the systemd target starting the app units at boot.
+	appUnitWantedBy = "multi-user.target"
+)
+
+var (
+	// appImage is the image of the app container started at VM boot.
+	appImage string
+	// appName is the name of the app container, defaults to the image name.
+	appName string
+	// vmAppCmd is the command of the app container.
+	vmAppCmd string
+	// vmAppArgs are the arguments of the app container command.
+	vmAppArgs []string
+	// vmAppEnv are the environment variables of the app container.
+	vmAppEnv []string
+	// vmAppNetHost enables host networking for the app container.
+	vmAppNetHost bool
+	// vmAppMounts are the bind mounts of the app container, in
+	// <vm-path>:<container-path>[:ro|rw] format.
+	vmAppMounts []string
+
+	// appNameRegexp matches the valid app names, which are used in the
+	// container and systemd unit names.
+	appNameRegexp = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_.-]*$`)
+)
+
+// appSpec is an application container started at VM boot.
+type appSpec struct {
+	// Name is the name of the container. Defaults to the image name.
+	Name string `json:"name"`
+	// Image is the image of the container, which must be loaded in the VM
+	// image.
+	Image string `json:"image"`
+	// Cmd is the command of the container, optional.
+	Cmd string `json:"cmd"`
+	// Args are the arguments of the command.
+	Args []string `json:"args"`
+	// Env are the environment variables in KEY=value format.
+	Env []string `json:"env"`
+	// NetHost enables host networking.
+	NetHost bool `json:"netHost"`
+	// Mounts are the bind mounts of VM paths in the container, in
+	// <vm-path>:<container-path>[:ro|rw] format.
+	Mounts []string `json:"mounts"`
+}
+
+// setDefaults sets the default values of the unset optional fields.
+func (a *appSpec) setDefaults() {
+	if a.Name == "" && a.Image != "" {
+		a.Name = defaultAppName(a.Image)
+	}
+}
+
+// validate checks if the app is complete and usable.
+func (a *appSpec) validate() error {
+	if a.Image == "" {
+		return errors.New("image must be set")
+	}
+	if !appNameRegexp.MatchString(a.Name) {
+		return fmt.Errorf("invalid name %q, want letters, digits and _.- only", a.Name)
+	}
+	if len(a.Args) > 0 && a.Cmd == "" {
+		return errors.New("args need a cmd")
+	}
+	for _, env := range a.Env {
+		if !strings.Contains(env, "=") {
+			return fmt.Errorf("invalid env %q, want KEY=value", env)
+		}
+	}
+	for _, m := range a.Mounts {
+		if _, err := parseAppMount(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// container returns the container of the app.
+func (a *appSpec) container() (appContainer, error) {
+	app := appContainer{
+		Name:    a.Name,
+		Image:   a.Image,
+		Cmd:     a.Cmd,
+		Args:    a.Args,
+		Env:     a.Env,
+		NetHost: a.NetHost,
+	}
+	for _, m := range a.Mounts {
+		mount, err := parseAppMount(m)
+		if err != nil {
+			return appContainer{}, err
+		}
+		app.Mounts = append(app.Mounts, mount)
+	}
+	return app, nil
+}
+
+// defaultAppName returns the app name of an image, the last path element of
+// the image name without the tag and digest.
+func defaultAppName(image string) string {
+	name := path.Base(image)
+	if i := strings.IndexAny(name, ":@"); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
+
+// parseAppMount parses a bind mount in <source>:<destination>[:ro|rw] format.
+// The mount is read-write by default.
+func parseAppMount(s string) (appMount, error) {
+	parts := strings.Split(s, ":")
+	if len(parts) < 2 || len(parts) > 3 {
+		return appMount{}, fmt.Errorf("invalid mount %q, want <source>:<destination>[:ro|rw]", s)
+	}
+
+	m := appMount{Source: parts[0], Destination: parts[1]}
+	if !path.IsAbs(m.Source) || !path.IsAbs(m.Destination) {
+		return appMount{}, fmt.Errorf("invalid mount %q, the paths must be absolute", s)
+	}
+	if len(parts) == 3 {
+		switch parts[2] {
+		case "ro":
+			m.ReadOnly = true
+		case "rw":
+		default:
+			return appMount{}, fmt.Errorf("invalid mount %q, unknown mode %q, want ro or rw", s, parts[2])
+		}
+	}
+	return m, nil
+}
+
+// appUnitName returns the name of the systemd unit of an app.
+func appUnitName(name string) string {
+	return appUnitPrefix + name + ".service"
+}
+
+// appUnit returns the systemd unit running an app container at boot. The
+// runtime daemon is started along with the unit.
+func appUnit(rt containerRuntime, namespace string, app appContainer) string {
+	svc := rt.AppService(namespace, app)
+
+	var unit strings.Builder
+	fmt.Fprintf(&unit, "[Unit]\n")
+	fmt.Fprintf(&unit, "Description=ignite-cntr app %s\n", app.Name)
+	fmt.Fprintf(&unit, "Requires=%s\n", svc.Requires)
+	fmt.Fprintf(&unit, "After=%s network-online.target\n", svc.Requires)
+	fmt.Fprintf(&unit, "Wants=network-online.target\n")
+	fmt.Fprintf(&unit, "\n[Service]\n")
+	for _, cmd := range svc.ExecStartPre {
+		fmt.Fprintf(&unit, "ExecStartPre=-%s\n", systemdCommandLine(cmd))
+	}
+	fmt.Fprintf(&unit, "ExecStart=%s\n", systemdCommandLine(svc.ExecStart))
+	fmt.Fprintf(&unit, "ExecStop=%s\n", systemdCommandLine(svc.ExecStop))
+	fmt.Fprintf(&unit, "Restart=always\n")
+	fmt.Fprintf(&unit, "RestartSec=5\n")
+	fmt.Fprintf(&unit, "\n[Install]\n")
+	fmt.Fprintf(&unit, "WantedBy=%s\n", appUnitWantedBy)
+	return unit.String()
+}
+
+// systemdCommandLine returns a command line of a systemd unit. The arguments
+// are quoted when needed, and the systemd specifiers and variables escaped.
+func systemdCommandLine(args []string) string {
+	quoted := make([]string, len(args))
+	for i, arg := range args {
+		arg = strings.NewReplacer("%", "%%", "$", "$$").Replace(arg)
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\;") {
+			arg = `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(arg) + `"`
+		}
+		quoted[i] = arg
+	}
+	return strings.Join(quoted, " ")
+}
+
+// installApps installs and enables the systemd units of the apps in the build
+// sandbox. The app images must be listed in rtImages.
+func installApps(sb buildSandbox, rt containerRuntime, namespace string, apps []appSpec, rtImages map[string]runtimeImage) error {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, spec := range apps {
+		if _, ok := rtImages[normalizeImageRef(spec.Image)]; !ok {
+			return fmt.Errorf("image %q of app %q is not loaded in the VM image", spec.Image, spec.Name)
+		}
+		app, err := spec.container()
+		if err != nil {
+			return fmt.Errorf("invalid app %q: %v", spec.Name, err)
+		}
+		// ctr only finds the images by their stored, fully qualified name.
+		app.Image = normalizeImageRef(spec.Image)
+
+		fmt.Printf("Installing app %s (%s)...\n", app.Name, appUnitName(app.Name))
+		unit := appUnit(rt, namespace, app)
+		unitPath := path.Join(systemdUnitDir, appUnitName(app.Name))
+		if err := tw.WriteHeader(&tar.Header{Name: unitPath, Mode: 0644, Size: int64(len(unit))}); err != nil {
+			return err
+		}
+		if _, err := tw.Write([]byte(unit)); err != nil {
+			return err
+		}
+
+		// Enable the unit like systemctl enable, systemd isn't running in
+		// the build sandbox.
+		link := &tar.Header{
+			Name:     path.Join(systemdUnitDir, appUnitWantedBy+".wants", appUnitName(app.Name)),
+			Typeflag: tar.TypeSymlink,
+			Linkname: "/" + unitPath,
+			Mode:     0777,
+		}
+		if err := tw.WriteHeader(link); err != nil {
+			return err
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+
+	if err := extractInSandbox(sb, "/", &buf); err != nil {
+		return fmt.Errorf("failed to install the app units: %v", err)
+	}
+	return nil
+}
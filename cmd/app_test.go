@@ -0,0 +1,64 @@
+package cmd
+
+import "testing"
+
+func TestSystemdCommandLine(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{
+			name: "plain",
+			args: []string{"/usr/bin/ctr", "run", "--rm", "docker.io/library/nginx:latest", "nginx"},
+			want: "/usr/bin/ctr run --rm docker.io/library/nginx:latest nginx",
+		},
+		{
+			name: "space",
+			args: []string{"sh", "-c", "echo hello"},
+			want: `sh -c "echo hello"`,
+		},
+		{
+			name: "empty",
+			args: []string{"echo", ""},
+			want: `echo ""`,
+		},
+		{
+			name: "quotes",
+			args: []string{"echo", `say "hi"`, "it's"},
+			want: `echo "say \"hi\"" "it's"`,
+		},
+		{
+			name: "backslash",
+			args: []string{"echo", `a\b`},
+			want: `echo "a\\b"`,
+		},
+		{
+			name: "newline",
+			args: []string{"echo", "a\nb"},
+			want: `echo "a\nb"`,
+		},
+		{
+			name: "semicolon",
+			args: []string{"echo", "a;b"},
+			want: `echo "a;b"`,
+		},
+		{
+			name: "specifiers and variables",
+			args: []string{"--env", "HOME=$HOME", "100%"},
+			want: "--env HOME=$$HOME 100%%",
+		},
+		{
+			name: "escaped and quoted",
+			args: []string{"sh", "-c", "echo $HOME %h"},
+			want: `sh -c "echo $$HOME %%h"`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := systemdCommandLine(tt.args); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,163 @@
+package cmd
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+)
+
+// archiveImportDir is the directory in the build container where the local
+// image archives are copied before import. It's removed after the import to
+// keep the archives out of the VM image.
+const archiveImportDir = "/tmp/ignite-cntr-import"
+
+// archiveSpec is a local image archive to be imported in the VM image. The
+// archive can be a docker-archive created by "docker save", an OCI image
+// layout tarball or an OCI image layout directory.
+type archiveSpec struct {
+	// Path is the path of the archive file or OCI layout directory.
+	Path string `json:"path"`
+	// IndexName is the image name given to the imported OCI image index. It
+	// is needed when the OCI archive has no image name annotations.
+	IndexName string `json:"indexName"`
+}
+
+// importArchive copies a local image archive into the build container and
+// imports it into the given namespace of the container runtime. index is used
+// to name the archive in the build container uniquely.
+func importArchive(sb buildSandbox, rt containerRuntime, namespace string, index int, archive archiveSpec) error {
+	info, err := os.Stat(archive.Path)
+	if err != nil {
+		return fmt.Errorf("failed to read archive: %v", err)
+	}
+
+	// Name of the archive in the archive import dir.
+	name := strconv.Itoa(index)
+	if !info.IsDir() {
+		name += ".tar"
+	}
+
+	fmt.Printf("Copying archive %s into the build container...\n", archive.Path)
+	if err := uploadArchive(sb, archive.Path, name); err != nil {
+		return fmt.Errorf("failed to copy archive %q into the build container: %v", archive.Path, err)
+	}
+
+	archivePath := path.Join(archiveImportDir, name)
+
+	// The runtimes can only import tarballs. Pack the OCI layout directory in the
+	// build container.
+	if info.IsDir() {
+		layoutDir := archivePath
+		archivePath += ".tar"
+		packCmd := []string{"tar", "-cf", archivePath, "-C", layoutDir, "."}
+		if _, err := runExec(sb, packCmd); err != nil {
+			return fmt.Errorf("failed to pack OCI layout %q: %v", archive.Path, err)
+		}
+	}
+
+	fmt.Printf("Waiting for %s archive import to complete", archive.Path)
+	err = withProgressDots(func() error {
+		_, err := runExec(sb, rt.ImportCmd(namespace, archivePath, archive.IndexName))
+		return err
+	})
+	// Newline.
+	fmt.Println()
+	if err != nil {
+		return fmt.Errorf("failed to import archive %q: %v", archive.Path, err)
+	}
+
+	return nil
+}
+
+// cleanupArchivesCmd returns the command to remove the copied archives from
+// the build container.
+func cleanupArchivesCmd() []string {
+	return []string{"rm", "-rf", archiveImportDir}
+}
+
+// uploadArchive streams the archive file or directory at src into the archive
+// import dir of the build container with the given name.
+func uploadArchive(sb buildSandbox, src, name string) error {
+	pr, pw := io.Pipe()
+	go func() {
+		pw.CloseWithError(writeArchiveTar(pw, src, name))
+	}()
+
+	err := extractInSandbox(sb, path.Dir(archiveImportDir), pr)
+	// Unblock the writer if the upload failed before reading everything.
+	pr.CloseWithError(err)
+	return err
+}
+
+// writeArchiveTar writes a tar stream to w containing the file or directory at
+// src, placed at <archive-import-dir>/<name>.
+func writeArchiveTar(w io.Writer, src, name string) error {
+	tw := tar.NewWriter(w)
+
+	root := path.Base(archiveImportDir)
+	if err := tw.WriteHeader(&tar.Header{Name: root + "/", Mode: 0755, Typeflag: tar.TypeDir}); err != nil {
+		return err
+	}
+	if err := writeTarTree(tw, src, path.Join(root, name), nil); err != nil {
+		return err
+	}
+
+	return tw.Close()
+}
+
+// writeTarTree writes the file or directory at src to tw, placed at name in
+// the tar. normalize, if not nil, is called to modify the tar headers before
+// they're written. A symlink at src is followed, the symlinks in the tree are
+// written as is.
+func writeTarTree(tw *tar.Writer, src, name string, normalize func(*tar.Header)) error {
+	// filepath.Walk doesn't follow a symlinked root.
+	src, err := filepath.EvalSymlinks(src)
+	if err != nil {
+		return err
+	}
+	return filepath.Walk(src, func(file string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(file); err != nil {
+				return err
+			}
+		}
+		hdr, err := tar.FileInfoHeader(info, link)
+		if err != nil {
+			return err
+		}
+		hdr.Name = path.Join(name, filepath.ToSlash(rel))
+		if info.IsDir() {
+			hdr.Name += "/"
+		}
+		if normalize != nil {
+			normalize(hdr)
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(tw, f)
+		return err
+	})
+}
@@ -0,0 +1,245 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	reference "github.com/containerd/containerd/reference/docker"
+	homedir "github.com/mitchellh/go-homedir"
+)
+
+const (
+	// registryAuthEnv is the environment variable used to pass the registry
+	// credentials to the image pull command in the build container.
+	registryAuthEnv = "IGNITE_CNTR_REGISTRY_AUTH"
+
+	// dockerHubRegistry is the normalized registry host of Docker Hub.
+	dockerHubRegistry = "docker.io"
+	// dockerHubServerAddress is the Docker Hub server address used by docker
+	// in the docker config and the credential helpers.
+	dockerHubServerAddress = "https://index.docker.io/v1/"
+
+	// credentialHelperPrefix is the executable name prefix of the docker
+	// credential helpers.
+	credentialHelperPrefix = "docker-credential-"
+)
+
+// registryAuth is the credentials of a container image registry.
+type registryAuth struct {
+	Username string
+	Password string
+}
+
+// env returns the environment variable to pass the credentials to a pull
+// command.
+func (a *registryAuth) env() string {
+	return fmt.Sprintf("%s=%s:%s", registryAuthEnv, a.Username, a.Password)
+}
+
+// dockerConfigFile is the part of the docker config.json with the registry
+// credentials configuration.
+type dockerConfigFile struct {
+	Auths       map[string]dockerConfigAuth `json:"auths"`
+	CredsStore  string                      `json:"credsStore"`
+	CredHelpers map[string]string           `json:"credHelpers"`
+}
+
+// dockerConfigAuth is a registry credential entry in the docker config.json.
+type dockerConfigAuth struct {
+	Auth          string `json:"auth"`
+	IdentityToken string `json:"identitytoken"`
+}
+
+// registryAuthStore looks up the credentials of registries from the explicitly
+// passed credentials and the host docker config.
+type registryAuthStore struct {
+	// explicit are the credentials passed with flags, keyed by the registry
+	// host.
+	explicit map[string]*registryAuth
+	// config is the host docker config. nil when there's no docker config.
+	config *dockerConfigFile
+}
+
+// newRegistryAuthStore parses the registry credentials passed as
+// <registry>=<username>:<password> and reads the host docker config to create
+// a registry auth store.
+func newRegistryAuthStore(flagAuths []string) (*registryAuthStore, error) {
+	store := &registryAuthStore{
+		explicit: map[string]*registryAuth{},
+	}
+
+	for _, flagAuth := range flagAuths {
+		registry, creds := splitKeyValue(flagAuth, "=")
+		username, password := splitKeyValue(creds, ":")
+		if registry == "" || username == "" || password == "" {
+			// Don't print the flag value, it may contain a password.
+			return nil, errors.New("invalid registry auth, want <registry>=<username>:<password>")
+		}
+		store.explicit[normalizeRegistryHost(registry)] = &registryAuth{
+			Username: username,
+			Password: password,
+		}
+	}
+
+	config, err := readDockerConfig()
+	if err != nil {
+		return nil, err
+	}
+	store.config = config
+
+	return store, nil
+}
+
+// authFor returns the registry host of the given image and its credentials.
+// nil credentials are returned when no credentials are found.
+func (s *registryAuthStore) authFor(image string) (string, *registryAuth, error) {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return "", nil, fmt.Errorf("invalid image reference %q: %v", image, err)
+	}
+	registry := reference.Domain(named)
+	auth, err := s.authForRegistry(registry)
+	return registry, auth, err
+}
+
+// authForRegistry returns the credentials for the given registry host. nil is
+// returned when no credentials are found.
+func (s *registryAuthStore) authForRegistry(registry string) (*registryAuth, error) {
+	registry = normalizeRegistryHost(registry)
+
+	if auth, ok := s.explicit[registry]; ok {
+		return auth, nil
+	}
+	if s.config == nil {
+		return nil, nil
+	}
+
+	// Credential helpers take precedence over the stored credentials, like in
+	// docker.
+	for server, helper := range s.config.CredHelpers {
+		if normalizeRegistryHost(server) == registry {
+			return credentialHelperAuth(helper, server)
+		}
+	}
+	if s.config.CredsStore != "" {
+		return credentialHelperAuth(s.config.CredsStore, registryServerAddress(registry))
+	}
+
+	for server, auth := range s.config.Auths {
+		if normalizeRegistryHost(server) != registry {
+			continue
+		}
+		if auth.IdentityToken != "" {
+			return nil, fmt.Errorf("identity token credentials of registry %q are not supported", registry)
+		}
+		if auth.Auth == "" {
+			continue
+		}
+		decoded, err := base64.StdEncoding.DecodeString(auth.Auth)
+		if err != nil {
+			return nil, fmt.Errorf("failed to decode credentials of registry %q: %v", registry, err)
+		}
+		username, password := splitKeyValue(string(decoded), ":")
+		return &registryAuth{Username: username, Password: password}, nil
+	}
+
+	return nil, nil
+}
+
+// readDockerConfig reads the docker config of the host user. nil is returned
+// when no docker config is found.
+func readDockerConfig() (*dockerConfigFile, error) {
+	configDir := os.Getenv("DOCKER_CONFIG")
+	if configDir == "" {
+		home, err := homedir.Dir()
+		if err != nil {
+			return nil, err
+		}
+		configDir = filepath.Join(home, ".docker")
+	}
+
+	configPath := filepath.Join(configDir, "config.json")
+	data, err := ioutil.ReadFile(configPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read docker config: %v", err)
+	}
+
+	config := &dockerConfigFile{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, fmt.Errorf("failed to parse docker config %q: %v", configPath, err)
+	}
+	return config, nil
+}
+
+// credentialHelperAuth gets the credentials of a registry server from a docker
+// credential helper. nil is returned when the helper has no credentials for
+// the server.
+func credentialHelperAuth(helper, server string) (*registryAuth, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command(credentialHelperPrefix+helper, "get")
+	cmd.Stdin = strings.NewReader(server)
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// The credential helpers report missing credentials in the output.
+		if strings.Contains(stdout.String(), "credentials not found") {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("credential helper %q failed: %v: %s", helper, err, strings.TrimSpace(stderr.String()+stdout.String()))
+	}
+
+	creds := struct {
+		Username string
+		Secret   string
+	}{}
+	if err := json.Unmarshal(stdout.Bytes(), &creds); err != nil {
+		return nil, fmt.Errorf("failed to parse credential helper %q output: %v", helper, err)
+	}
+	if creds.Username == "<token>" {
+		return nil, errors.New("identity token credentials are not supported")
+	}
+	return &registryAuth{Username: creds.Username, Password: creds.Secret}, nil
+}
+
+// normalizeRegistryHost returns the registry host of a registry server
+// address, with Docker Hub addresses normalized to docker.io.
+func normalizeRegistryHost(server string) string {
+	host := strings.TrimPrefix(server, "https://")
+	host = strings.TrimPrefix(host, "http://")
+	host = strings.SplitN(host, "/", 2)[0]
+
+	switch host {
+	case "index.docker.io", "registry-1.docker.io":
+		return dockerHubRegistry
+	}
+	return host
+}
+
+// registryServerAddress returns the server address used by docker for the
+// given registry host.
+func registryServerAddress(registry string) string {
+	if registry == dockerHubRegistry {
+		return dockerHubServerAddress
+	}
+	return registry
+}
+
+// splitKeyValue splits s at the first sep into a key and a value.
+func splitKeyValue(s, sep string) (string, string) {
+	kv := strings.SplitN(s, sep, 2)
+	if len(kv) < 2 {
+		return kv[0], ""
+	}
+	return kv[0], kv[1]
+}
@@ -3,8 +3,14 @@ package cmd
 import (
 	"archive/tar"
 	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"path"
+	"strconv"
+	"strings"
 	"time"
 
 	docker "github.com/fsouza/go-dockerclient"
@@ -24,6 +30,37 @@ const (
 var (
 	// baseFromImage is the flag variable to store the from image of the base.
 	baseFromImage string
+	// basePlatform is the platform of the base image.
+	basePlatform string
+	// baseRuntime is the container runtime installed in the base image.
+	baseRuntime string
+	// baseSpecFile is the path of a base image build spec file.
+	baseSpecFile string
+	// baseRuntimeVersion is the pinned version of the runtime package.
+	baseRuntimeVersion string
+	// baseRuntimeConfig is the path of the runtime config file to install.
+	baseRuntimeConfig string
+	// basePackages are the extra apt packages to install.
+	basePackages []string
+	// baseFiles are the extra files to copy into the image, <src>:<dest>.
+	baseFiles []string
+	// baseLogFile is the path of the build log file.
+	baseLogFile string
+	// baseOutput is the output format of the build progress.
+	baseOutput string
+	// baseReproducible enables the reproducible build mode.
+	baseReproducible bool
+)
+
+const (
+	// sourceDateEpochEnv is the environment variable with the timestamp used
+	// in reproducible builds, in seconds since the Unix epoch.
+	// https://reproducible-builds.org/specs/source-date-epoch/
+	sourceDateEpochEnv = "SOURCE_DATE_EPOCH"
+
+	// createdLabel is the OCI annotation of the image creation time, set in
+	// reproducible builds.
+	createdLabel = "org.opencontainers.image.created"
 )
 
 // baseCmd represents the base command
@@ -31,7 +68,10 @@ var baseCmd = &cobra.Command{
 	Use:   "base [<base-image-name>]",
 	Short: "Create VM base image.",
 	Long: `Create base image for the VM image. This base image contains a container
-runtime and other common dependencies.`,
+runtime and other common dependencies.
+
+The build can also be described in a spec file passed with --file. Flags and
+arguments passed along with a spec file override the values in the spec.`,
 	Args: func(cmd *cobra.Command, args []string) error {
 		if len(args) > 1 {
 			return errors.New("require at one or no base image name argument")
@@ -39,30 +79,338 @@ runtime and other common dependencies.`,
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		targetImage := defaultBaseImage
-		if len(args) == 1 {
-			targetImage = args[0]
+		spec, err := baseImageSpecFromFlags(cmd, args)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			return
 		}
-		if err := runBase(baseFromImage, targetImage); err != nil {
+		out, err := newBuildOutput(baseOutput, baseLogFile)
+		if err != nil {
 			fmt.Printf("error: %v\n", err)
+			return
+		}
+		defer out.close()
+		if err := runBase(spec, out, baseReproducible); err != nil {
+			out.errorf("%v", err)
 		}
 	},
 }
 
-func runBase(baseFromImage, targetImage string) error {
+// baseImageSpecFromFlags constructs a base image spec from the spec file, if
+// any, and the command flags and arguments.
+func baseImageSpecFromFlags(cmd *cobra.Command, args []string) (*baseImageSpec, error) {
+	spec := &baseImageSpec{}
+	if baseSpecFile != "" {
+		var err error
+		if spec, err = loadBaseImageSpec(baseSpecFile); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(args) == 1 {
+		spec.Name, spec.Tag = splitImageRef(args[0])
+	}
+	if cmd.Flags().Changed("baseImage") || spec.FromImage == "" {
+		spec.FromImage = baseFromImage
+	}
+	if cmd.Flags().Changed("runtime") || spec.Runtime == "" {
+		spec.Runtime = baseRuntime
+	}
+	if basePlatform != "" {
+		spec.Platform = basePlatform
+	}
+	if baseRuntimeVersion != "" {
+		spec.RuntimeVersion = baseRuntimeVersion
+	}
+	if baseRuntimeConfig != "" {
+		spec.RuntimeConfig = baseRuntimeConfig
+	}
+	spec.Packages = append(spec.Packages, basePackages...)
+	if err := spec.addFiles(baseFiles); err != nil {
+		return nil, err
+	}
+	spec.setDefaults()
+
+	if err := spec.validate(); err != nil {
+		return nil, fmt.Errorf("invalid base image spec: %v", err)
+	}
+	return spec, nil
+}
+
+// runBase builds a base image, printing the progress and build logs to out. In
+// reproducible mode, the build context and image metadata timestamps are set
+// from SOURCE_DATE_EPOCH.
+func runBase(spec *baseImageSpec, out *buildOutput, reproducible bool) error {
+	rt, err := getContainerRuntime(spec.Runtime)
+	if err != nil {
+		return err
+	}
+
+	// The runtime label tells the VM image builds and runs which runtime to
+	// use.
+	labels := map[string]string{runtimeLabel: rt.Name()}
+	platform := spec.Platform
+	if platform != "" {
+		if platform, err = normalizePlatform(platform); err != nil {
+			return err
+		}
+		labels[platformLabel] = platform
+	}
+
+	var epoch *time.Time
+	var buildArgs []docker.BuildArg
+	if reproducible {
+		if epoch, err = sourceDateEpoch(); err != nil {
+			return err
+		}
+		labels[createdLabel] = epoch.Format(time.RFC3339)
+		buildArgs = append(buildArgs, docker.BuildArg{
+			Name:  sourceDateEpochEnv,
+			Value: strconv.FormatInt(epoch.Unix(), 10),
+		})
+		out.printf("Reproducible build with timestamp %s\n", epoch.Format(time.RFC3339))
+	}
+
+	if builderName == builderContainerd {
+		return buildBaseInSandbox(spec, rt, labels, platform, epoch, out)
+	}
+
 	client, err := docker.NewClientFromEnv()
 	if err != nil {
 		return err
 	}
 
-	// Write dockerfile in tar format as input to the docker build server.
+	// Write the build context in tar format as input to the docker build
+	// server.
+	inputbuf := bytes.NewBuffer(nil)
+	if err := writeBaseBuildContext(inputbuf, spec, rt, epoch); err != nil {
+		return fmt.Errorf("failed to create the build context: %v", err)
+	}
+
+	// Stream the build logs, as JSON messages in JSON output.
+	var logStream io.Writer = out.log
+	jsonStream := &jsonStreamWriter{w: out.log}
+	if out.json {
+		logStream = jsonStream
+	}
+	opts := docker.BuildImageOptions{
+		Name:          spec.imageRef(),
+		InputStream:   inputbuf,
+		OutputStream:  logStream,
+		RawJSONStream: out.json,
+		Platform:      platform,
+		Labels:        labels,
+		BuildArgs:     buildArgs,
+	}
+	out.printf("Building image with %s runtime...\n", rt.Name())
+	if err := client.BuildImage(opts); err != nil {
+		return err
+	}
+	if err := jsonStream.error(); err != nil {
+		return err
+	}
+	// docker build sets the image and history creation times to the build
+	// time.
+	if epoch != nil {
+		if _, err := setDockerImageCreated(client, spec.imageRef(), *epoch); err != nil {
+			return err
+		}
+	}
+
+	out.printf("Base image built: %s\n", spec.imageRef())
+	return nil
+}
+
+// buildBaseInSandbox builds a base image in a build container of the
+// containerd builder. The steps of the base Dockerfile are run in the build
+// container, which is then committed with the given labels.
+func buildBaseInSandbox(spec *baseImageSpec, rt containerRuntime, labels map[string]string, platform string, epoch *time.Time, out *buildOutput) (retErr error) {
+	b, err := newImageBuilder(builderContainerd)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	if _, platform, err = ensureBaseImage(b, spec.FromImage, platform); err != nil {
+		return err
+	}
+	sb, err := b.CreateSandbox(newBuildContainerName(), spec.FromImage, platform)
+	if err != nil {
+		return err
+	}
+
+	// Remove the build container when the build returns or is interrupted.
+	cleanup := newBuildContainerCleanup(sb, false)
+	defer func() {
+		if err := cleanup.run(); err != nil {
+			if retErr == nil {
+				retErr = err
+				return
+			}
+			out.errorf("%v", err)
+		}
+	}()
+	stopInterruptHandler := handleInterrupt(cleanup)
+	defer stopInterruptHandler()
+
+	// Stream the build logs, as JSON messages in JSON output.
+	var logStream io.Writer = out.log
+	if out.json {
+		logStream = &jsonStreamEncoder{w: out.log}
+	}
+
+	var env []string
+	if epoch != nil {
+		env = append(env, fmt.Sprintf("%s=%d", sourceDateEpochEnv, epoch.Unix()))
+	}
+	out.printf("Building image with %s runtime in build container %s...\n", rt.Name(), sb.Name())
+	installOpts := execOptions{
+		Cmd:    []string{"sh", "-c", baseInstallScript(spec, rt)},
+		Env:    env,
+		Output: logStream,
+	}
+	if _, err := execInSandbox(sb, installOpts); err != nil {
+		return fmt.Errorf("failed to install packages: %v", err)
+	}
+
+	normalize := tarNormalizer(epoch)
+	for _, file := range spec.allFiles(rt) {
+		out.printf("Copying %s to %s...\n", file.Src, file.Dest)
+		if err := copyToSandbox(sb, file, normalize); err != nil {
+			return fmt.Errorf("failed to copy file %q: %v", file.Src, err)
+		}
+	}
+
+	if _, err := sb.Commit(commitOptions{Ref: spec.imageRef(), Labels: labels, Created: epoch}); err != nil {
+		return err
+	}
+
+	out.printf("Base image built: %s\n", spec.imageRef())
+	return nil
+}
+
+// copyToSandbox copies a local file or directory into the build sandbox at its
+// destination, like the COPY steps of the base Dockerfile. normalize, if not
+// nil, modifies the tar headers of the copied files.
+func copyToSandbox(sb buildSandbox, file fileSpec, normalize func(*tar.Header)) error {
+	if _, err := os.Stat(file.Src); err != nil {
+		return err
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		tw := tar.NewWriter(pw)
+		err := writeTarTree(tw, file.Src, strings.TrimPrefix(path.Clean(file.Dest), "/"), normalize)
+		if err == nil {
+			err = tw.Close()
+		}
+		pw.CloseWithError(err)
+	}()
+
+	err := extractInSandbox(sb, "/", pr)
+	// Unblock the writer if the extraction failed before reading everything.
+	pr.CloseWithError(err)
+	return err
+}
+
+// sourceDateEpoch returns the timestamp of reproducible builds from
+// SOURCE_DATE_EPOCH, the Unix epoch if unset.
+func sourceDateEpoch() (*time.Time, error) {
+	var sec int64
+	if v := os.Getenv(sourceDateEpochEnv); v != "" {
+		var err error
+		if sec, err = strconv.ParseInt(v, 10, 64); err != nil {
+			return nil, fmt.Errorf("invalid %s %q: %v", sourceDateEpochEnv, v, err)
+		}
+	}
+	t := time.Unix(sec, 0).UTC()
+	return &t, nil
+}
+
+// writeBaseBuildContext writes the docker build context of a base image in tar
+// format to w. The context contains the Dockerfile and the files copied into
+// the image, at files/<index>. If epoch is set, the file timestamps and owners
+// are normalized to make the context reproducible.
+func writeBaseBuildContext(w io.Writer, spec *baseImageSpec, rt containerRuntime, epoch *time.Time) error {
 	t := time.Now()
-	inputbuf, outputbuf := bytes.NewBuffer(nil), bytes.NewBuffer(nil)
-	tr := tar.NewWriter(inputbuf)
+	if epoch != nil {
+		t = *epoch
+	}
+	normalize := tarNormalizer(epoch)
+	tw := tar.NewWriter(w)
+
+	files := spec.allFiles(rt)
+	dockerfile, err := baseDockerfile(spec, rt, files, epoch != nil)
+	if err != nil {
+		return err
+	}
+	if err := tw.WriteHeader(&tar.Header{Name: "Dockerfile", Mode: 0644, Size: int64(len(dockerfile)), ModTime: t, AccessTime: t, ChangeTime: t}); err != nil {
+		return err
+	}
+	if _, err := tw.Write([]byte(dockerfile)); err != nil {
+		return err
+	}
+
+	for i, file := range files {
+		if _, err := os.Stat(file.Src); err != nil {
+			return fmt.Errorf("failed to read file: %v", err)
+		}
+		if err := writeTarTree(tw, file.Src, baseContextFile(i), normalize); err != nil {
+			return fmt.Errorf("failed to add file %q: %v", file.Src, err)
+		}
+	}
+
+	return tw.Close()
+}
+
+// tarNormalizer returns the tar header normalization of reproducible builds,
+// setting the timestamps to epoch and the owners to root. nil is returned if
+// epoch is nil.
+func tarNormalizer(epoch *time.Time) func(*tar.Header) {
+	if epoch == nil {
+		return nil
+	}
+	t := *epoch
+	return func(hdr *tar.Header) {
+		hdr.ModTime, hdr.AccessTime, hdr.ChangeTime = t, t, t
+		hdr.Uid, hdr.Gid = 0, 0
+		hdr.Uname, hdr.Gname = "", ""
+	}
+}
+
+// baseDockerfile returns the Dockerfile of a base image. files are copied into
+// the image from the build context. In reproducible builds, SOURCE_DATE_EPOCH
+// is passed to the build steps.
+func baseDockerfile(spec *baseImageSpec, rt containerRuntime, files []fileSpec, reproducible bool) (string, error) {
+	var dockerfile strings.Builder
+	fmt.Fprintf(&dockerfile, "FROM %s\n", spec.FromImage)
+	if reproducible {
+		fmt.Fprintf(&dockerfile, "ARG %s\n", sourceDateEpochEnv)
+	}
+	fmt.Fprintf(&dockerfile, "RUN %s\n", baseInstallScript(spec, rt))
 
-	dockerfile := fmt.Sprintf(`FROM %s
-RUN apt-get update -y \
-	&& apt-get install -y --no-install-recommends containerd \
+	// Use the JSON form of COPY to support paths with spaces.
+	for i, file := range files {
+		args, err := json.Marshal([]string{baseContextFile(i), file.Dest})
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&dockerfile, "COPY %s\n", args)
+	}
+
+	return dockerfile.String(), nil
+}
+
+// baseInstallScript returns the shell script installing the runtime and extra
+// packages of a base image and cleaning up after the install.
+func baseInstallScript(spec *baseImageSpec, rt containerRuntime) string {
+	packages := append(rt.Packages(spec.RuntimeVersion), spec.Packages...)
+	install := ""
+	if script := rt.InstallScript(); script != "" {
+		install = " \\\n\t&& " + script
+	}
+	return fmt.Sprintf(`apt-get update -y \
+	&& apt-get install -y --no-install-recommends %s%s \
 	&& apt-get clean -y \
 	&& rm -rf \
 		/var/cache/debconf/* \
@@ -72,24 +420,13 @@ RUN apt-get update -y \
 		/var/tmp/* \
 		/usr/share/doc/* \
 		/usr/share/man/* \
-		/usr/share/local/*`, baseFromImage)
-
-	tr.WriteHeader(&tar.Header{Name: "Dockerfile", Size: int64(len(dockerfile)), ModTime: t, AccessTime: t, ChangeTime: t})
-	tr.Write([]byte(dockerfile))
-	tr.Close()
-
-	opts := docker.BuildImageOptions{
-		Name:         targetImage,
-		InputStream:  inputbuf,
-		OutputStream: outputbuf,
-	}
-	fmt.Println("Building image...")
-	if err := client.BuildImage(opts); err != nil {
-		return err
-	}
+		/usr/share/local/*`, strings.Join(packages, " "), install)
+}
 
-	fmt.Printf("Base image built: %s\n", targetImage)
-	return nil
+// baseContextFile returns the path of a copied file in the base image build
+// context.
+func baseContextFile(index int) string {
+	return path.Join("files", strconv.Itoa(index))
 }
 
 func init() {
@@ -106,4 +443,14 @@ func init() {
 	// baseCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
 	baseCmd.Flags().StringVarP(&baseFromImage, "baseImage", "b", defaultFromImage, "Base image of the VM base image")
+	baseCmd.Flags().StringVar(&baseRuntime, "runtime", defaultContainerRuntime, fmt.Sprintf("Container runtime installed in the VM base image, one of: %s", strings.Join(containerRuntimeNames(), ", ")))
+	baseCmd.Flags().StringVar(&basePlatform, "platform", "", "Platform of the VM base image, <os>/<arch>[/<variant>] (default is the builder platform)")
+	baseCmd.Flags().StringVarP(&baseSpecFile, "file", "f", "", "Path of a base image build spec file")
+	baseCmd.Flags().StringVar(&baseRuntimeVersion, "runtime-version", "", "Version of the container runtime package to install (default is the latest available)")
+	baseCmd.Flags().StringVar(&baseRuntimeConfig, "runtime-config", "", "Path of a container runtime config file to install, e.g. a containerd config.toml")
+	baseCmd.Flags().StringArrayVar(&basePackages, "package", basePackages, "Set an extra apt package to install (<name>[=<version>])")
+	baseCmd.Flags().StringArrayVar(&baseFiles, "copy", baseFiles, "Set a local file or directory to copy into the image (<src>:<dest>)")
+	baseCmd.Flags().StringVar(&baseLogFile, "log-file", "", "Write the build logs to a file instead of stdout")
+	baseCmd.Flags().StringVarP(&baseOutput, "output", "o", outputText, "Output format of the build progress, text or json")
+	baseCmd.Flags().BoolVar(&baseReproducible, "reproducible", false, "Build reproducibly, with the timestamps set from SOURCE_DATE_EPOCH (default 0)")
 }
@@ -0,0 +1,166 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+const (
+	// baseImageSpecVersion is the version of the base image build spec
+	// supported by this version of ignite-cntr.
+	baseImageSpecVersion = "v1alpha1"
+)
+
+var (
+	// aptPackageRegexp matches an apt package name with an optional pinned
+	// version, <name>[=<version>].
+	aptPackageRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9+.-]*(=[A-Za-z0-9.+~:-]+)?$`)
+	// aptVersionRegexp matches an apt package version.
+	aptVersionRegexp = regexp.MustCompile(`^[A-Za-z0-9.+~:-]+$`)
+)
+
+// baseImageSpec is a declarative description of a VM base image build.
+type baseImageSpec struct {
+	// Version is the version of the spec format.
+	Version string `json:"version"`
+	// Name is the name of the resulting base image, without the tag.
+	Name string `json:"name"`
+	// Tag is the tag of the resulting base image.
+	Tag string `json:"tag"`
+	// FromImage is the image the base image is based on.
+	FromImage string `json:"fromImage"`
+	// Platform is the platform of the base image, in <os>/<arch>[/<variant>]
+	// format. Defaults to the builder platform.
+	Platform string `json:"platform"`
+	// Runtime is the container runtime installed in the base image.
+	Runtime string `json:"runtime"`
+	// RuntimeVersion pins the version of the runtime package. Defaults to the
+	// latest version available in the from image distribution.
+	RuntimeVersion string `json:"runtimeVersion"`
+	// RuntimeConfig is the path of a runtime config file installed in the
+	// base image, e.g. a containerd config.toml.
+	RuntimeConfig string `json:"runtimeConfig"`
+	// Packages are the extra apt packages installed in the base image, in
+	// <name>[=<version>] format.
+	Packages []string `json:"packages"`
+	// Files are the extra local files copied into the base image.
+	Files []fileSpec `json:"files"`
+}
+
+// fileSpec is a local file or directory copied into an image.
+type fileSpec struct {
+	// Src is the local path of the file or directory.
+	Src string `json:"src"`
+	// Dest is the absolute path of the file in the image. The contents of a
+	// directory are copied into Dest.
+	Dest string `json:"dest"`
+}
+
+// loadBaseImageSpec reads a base image spec file and returns the spec with the
+// defaults applied.
+func loadBaseImageSpec(path string) (*baseImageSpec, error) {
+	spec := &baseImageSpec{}
+	if err := readSpecFile(path, spec); err != nil {
+		return nil, err
+	}
+	if spec.Version == "" {
+		return nil, fmt.Errorf("spec file %q has no version, want %q", path, baseImageSpecVersion)
+	}
+	spec.setDefaults()
+
+	return spec, nil
+}
+
+// setDefaults sets the default values of the unset optional fields.
+func (s *baseImageSpec) setDefaults() {
+	if s.Version == "" {
+		s.Version = baseImageSpecVersion
+	}
+	if s.Name == "" {
+		s.Name, s.Tag = splitImageRef(defaultBaseImage)
+	}
+	if s.Tag == "" {
+		s.Tag = "latest"
+	}
+	if s.FromImage == "" {
+		s.FromImage = defaultFromImage
+	}
+	if s.Runtime == "" {
+		s.Runtime = defaultContainerRuntime
+	}
+}
+
+// imageRef returns the base image reference in <name>:<tag> format.
+func (s *baseImageSpec) imageRef() string {
+	return fmt.Sprintf("%s:%s", s.Name, s.Tag)
+}
+
+// addFiles appends the files passed as <src>:<dest> to the spec files.
+func (s *baseImageSpec) addFiles(files []string) error {
+	for _, file := range files {
+		src, dest := splitKeyValue(file, ":")
+		if src == "" || dest == "" {
+			return fmt.Errorf("invalid file %q, want <src>:<dest>", file)
+		}
+		s.Files = append(s.Files, fileSpec{Src: src, Dest: dest})
+	}
+	return nil
+}
+
+// allFiles returns the files copied into the base image, including the
+// runtime config file.
+func (s *baseImageSpec) allFiles(rt containerRuntime) []fileSpec {
+	files := append([]fileSpec{}, s.Files...)
+	if s.RuntimeConfig != "" {
+		files = append(files, fileSpec{Src: s.RuntimeConfig, Dest: rt.ConfigPath()})
+	}
+	return files
+}
+
+// validate checks if the spec is complete and usable for a build.
+func (s *baseImageSpec) validate() error {
+	if s.Version != baseImageSpecVersion {
+		return fmt.Errorf("unsupported spec version %q, want %q", s.Version, baseImageSpecVersion)
+	}
+	if s.Name == "" {
+		return errors.New("base image name must be set")
+	}
+	if strings.Contains(s.Tag, ":") || strings.Contains(s.Tag, "/") {
+		return fmt.Errorf("invalid base image tag %q", s.Tag)
+	}
+	if s.FromImage == "" {
+		return errors.New("from image must be set")
+	}
+	if s.Platform != "" {
+		if _, err := normalizePlatform(s.Platform); err != nil {
+			return err
+		}
+	}
+	if _, err := getContainerRuntime(s.Runtime); err != nil {
+		return err
+	}
+	if s.RuntimeVersion != "" && !aptVersionRegexp.MatchString(s.RuntimeVersion) {
+		return fmt.Errorf("invalid runtime version %q", s.RuntimeVersion)
+	}
+
+	// The packages are passed to apt-get in the Dockerfile shell command.
+	for i, pkg := range s.Packages {
+		if !aptPackageRegexp.MatchString(pkg) {
+			return fmt.Errorf("packages[%d]: invalid package %q, want <name>[=<version>]", i, pkg)
+		}
+	}
+
+	for i, file := range s.Files {
+		if file.Src == "" {
+			return fmt.Errorf("files[%d]: source path must be set", i)
+		}
+		if !path.IsAbs(file.Dest) {
+			return fmt.Errorf("files[%d]: destination path %q must be absolute", i, file.Dest)
+		}
+	}
+
+	return nil
+}
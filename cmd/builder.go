@@ -0,0 +1,197 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"math/rand"
+	"strings"
+	"time"
+
+	docker "github.com/fsouza/go-dockerclient"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// Image build backends.
+const (
+	builderDocker     = "docker"
+	builderContainerd = "containerd"
+)
+
+var (
+	// builderName is the image build backend.
+	builderName string
+	// containerdAddress is the address of the host containerd socket used by
+	// the containerd builder.
+	containerdAddress string
+	// containerdBuildNamespace is the host containerd namespace of the
+	// containerd builder.
+	containerdBuildNamespace string
+)
+
+// imageBuilder is an image build backend. It creates the build containers,
+// called build sandboxes, and stores the images.
+type imageBuilder interface {
+	// Name returns the name of the builder.
+	Name() string
+	// EnsureImage ensures that an image is available locally, pulling it for
+	// the given platform if needed, and returns the image. An empty platform
+	// is the builder default platform.
+	EnsureImage(image, platform string) (*builderImage, error)
+	// InspectImage returns a local image.
+	InspectImage(image string) (*builderImage, error)
+	// CreateSandbox creates and starts a build sandbox with the given name from
+	// a local image of the given platform.
+	CreateSandbox(name, image, platform string) (buildSandbox, error)
+	// ListSandboxes returns the build sandboxes of the builder.
+	ListSandboxes() ([]sandboxInfo, error)
+	// RemoveSandbox removes the build sandbox with the given name.
+	RemoveSandbox(name string) error
+	// PushImage pushes a local image to its registry, with the credentials of
+	// the registry if not nil, printing the progress to out. It returns the
+	// digest of the pushed manifest.
+	PushImage(image string, auth *registryAuth, registry string, out io.Writer) (string, error)
+	// Close releases the resources of the builder.
+	Close() error
+}
+
+// builderImage is a local image of a builder.
+type builderImage struct {
+	// ID is the digest of the image config.
+	ID string
+	// Platform is the platform of the image.
+	Platform specs.Platform
+	// Labels are the labels of the image config.
+	Labels map[string]string
+}
+
+// sandboxInfo describes an existing build sandbox.
+type sandboxInfo struct {
+	// Name is the name of the sandbox.
+	Name string
+	// Created is the creation time of the sandbox.
+	Created time.Time
+}
+
+// buildSandbox is a privileged build container running an infinite sleep, in
+// which the build commands are executed.
+type buildSandbox interface {
+	// Name returns the name of the sandbox.
+	Name() string
+	// Exec runs a command in the sandbox and returns its exit code once it
+	// exits.
+	Exec(opts execOptions) (int, error)
+	// Start runs a command in the background, e.g. a daemon.
+	Start(cmd []string) error
+	// Commit creates an image from the filesystem of the sandbox and returns
+	// the image ID.
+	Commit(opts commitOptions) (string, error)
+	// Remove removes the sandbox.
+	Remove() error
+}
+
+// execOptions are the options of a command run in a build sandbox.
+type execOptions struct {
+	// Cmd is the command and its arguments.
+	Cmd []string
+	// Env are the extra environment variables of the command, KEY=value.
+	Env []string
+	// Stdin is the stdin of the command, nil for none.
+	Stdin io.Reader
+	// Output receives the combined stdout and stderr of the command.
+	Output io.Writer
+}
+
+// commitOptions are the options of a sandbox commit.
+type commitOptions struct {
+	// Ref is the reference of the created image.
+	Ref string
+	// Labels are the labels added to the image config.
+	Labels map[string]string
+	// Squash creates the image with a single layer of the whole sandbox
+	// filesystem instead of adding a layer on top of the sandbox image.
+	Squash bool
+	// Env are the environment variables set in the image config, in
+	// KEY=value format. They replace the image variables with the same keys.
+	Env []string
+	// Created is the creation time of the image and of its commit history
+	// entry, for reproducible builds. The current time if nil.
+	Created *time.Time
+}
+
+// newImageBuilder returns the image builder with the given name.
+func newImageBuilder(name string) (imageBuilder, error) {
+	switch name {
+	case builderDocker:
+		client, err := docker.NewClientFromEnv()
+		if err != nil {
+			return nil, err
+		}
+		return &dockerBuilder{client: client}, nil
+	case builderContainerd:
+		return newContainerdBuilder(containerdAddress, containerdBuildNamespace)
+	default:
+		return nil, fmt.Errorf("unknown builder %q, want %s or %s", name, builderDocker, builderContainerd)
+	}
+}
+
+// newBuildContainerName returns a random build container name.
+func newBuildContainerName() string {
+	rand.Seed(time.Now().UnixNano())
+	return fmt.Sprintf("%s-%d", buildContainerPrefix, rand.Int())
+}
+
+// runExec runs a command in the build sandbox, waits for it to complete and
+// returns the combined stdout and stderr of the command. An error is returned
+// if the command exits with a non-zero exit code.
+func runExec(sb buildSandbox, cmd []string) ([]byte, error) {
+	return execInSandbox(sb, execOptions{Cmd: cmd})
+}
+
+// execInSandbox runs a command in the build sandbox like runExec. The output is
+// also streamed to opts.Output if set.
+func execInSandbox(sb buildSandbox, opts execOptions) ([]byte, error) {
+	var output bytes.Buffer
+	if opts.Output != nil {
+		opts.Output = io.MultiWriter(&output, opts.Output)
+	} else {
+		opts.Output = &output
+	}
+
+	code, err := sb.Exec(opts)
+	if err != nil {
+		return output.Bytes(), err
+	}
+	if code != 0 {
+		return output.Bytes(), fmt.Errorf("exited with code %d: %s", code, outputTail(output.String()))
+	}
+	return output.Bytes(), nil
+}
+
+// extractInSandbox extracts a tar stream into dir in the build sandbox. The
+// extracted files are owned by root, like the files copied by docker.
+func extractInSandbox(sb buildSandbox, dir string, r io.Reader) error {
+	cmd := []string{"tar", "-x", "--no-same-owner", "-C", dir, "-f", "-"}
+	_, err := execInSandbox(sb, execOptions{Cmd: cmd, Stdin: r})
+	return err
+}
+
+// mergeEnv returns the environment variables of env with the variables of
+// override, which replace the variables with the same keys.
+func mergeEnv(env, override []string) []string {
+	merged := append([]string{}, env...)
+	for _, o := range override {
+		key := strings.SplitN(o, "=", 2)[0]
+		replaced := false
+		for i, e := range merged {
+			if strings.SplitN(e, "=", 2)[0] == key {
+				merged[i] = o
+				replaced = true
+			}
+		}
+		if !replaced {
+			merged = append(merged, o)
+		}
+	}
+	return merged
+}
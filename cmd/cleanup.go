@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// buildContainerCleanup removes a build container once, either when the build
+// returns or when the build is interrupted.
+type buildContainerCleanup struct {
+	once sync.Once
+	// sandbox is the build container to be removed.
+	sandbox buildSandbox
+	// keep disables the removal of the build container, for debugging.
+	keep bool
+	// err is the result of the removal.
+	err error
+}
+
+// newBuildContainerCleanup returns a cleanup for the given build container.
+func newBuildContainerCleanup(sandbox buildSandbox, keep bool) *buildContainerCleanup {
+	return &buildContainerCleanup{
+		sandbox: sandbox,
+		keep:    keep,
+	}
+}
+
+// run removes the build container if it's not already removed and returns the
+// result of the removal.
+func (c *buildContainerCleanup) run() error {
+	c.once.Do(func() {
+		if c.keep {
+			fmt.Printf("Keeping build container %s\n", c.sandbox.Name())
+			return
+		}
+
+		if err := c.sandbox.Remove(); err != nil {
+			c.err = fmt.Errorf("failed to remove build container %s: %v", c.sandbox.Name(), err)
+		}
+	})
+	return c.err
+}
+
+// handleInterrupt runs the cleanup and exits when the process receives SIGINT
+// or SIGTERM. The returned function stops the signal handling.
+func handleInterrupt(cleanup *buildContainerCleanup) func() {
+	sigCh := make(chan os.Signal, 1)
+	done := make(chan struct{})
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+
+	go func() {
+		select {
+		case sig := <-sigCh:
+			fmt.Printf("\nReceived %v, cleaning up...\n", sig)
+			if err := cleanup.run(); err != nil {
+				fmt.Printf("error: %v\n", err)
+			}
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+
+	return func() {
+		signal.Stop(sigCh)
+		close(done)
+	}
+}
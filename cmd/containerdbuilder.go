@@ -0,0 +1,574 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/content"
+	"github.com/containerd/containerd/diff"
+	"github.com/containerd/containerd/errdefs"
+	ctdimages "github.com/containerd/containerd/images"
+	ctdlabels "github.com/containerd/containerd/labels"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	"github.com/containerd/containerd/platforms"
+	remotedocker "github.com/containerd/containerd/remotes/docker"
+	"github.com/containerd/containerd/rootfs"
+	"github.com/containerd/containerd/snapshots"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+)
+
+const (
+	// defaultContainerdAddress is the default address of the host containerd
+	// socket.
+	defaultContainerdAddress = "/run/containerd/containerd.sock"
+
+	// defaultContainerdBuildNamespace is the default host containerd namespace
+	// of the containerd builder. It's the namespace of the ignite containerd
+	// runtime, for ignite to find the built VM images.
+	defaultContainerdBuildNamespace = "firecracker"
+)
+
+// containerdBuilder builds images with the host containerd, without docker.
+// The build sandboxes are containerd containers and the images are committed
+// by diffing the sandbox snapshot with the containerd diff service.
+type containerdBuilder struct {
+	client *containerd.Client
+	// ctx is the context of the builder namespace.
+	ctx context.Context
+}
+
+// newContainerdBuilder connects to the host containerd at address and returns
+// a builder using the given namespace.
+func newContainerdBuilder(address, namespace string) (*containerdBuilder, error) {
+	client, err := containerd.New(address, containerd.WithDefaultNamespace(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd at %q: %v", address, err)
+	}
+	return &containerdBuilder{
+		client: client,
+		ctx:    namespaces.WithNamespace(context.Background(), namespace),
+	}, nil
+}
+
+// Name returns the name of the builder.
+func (b *containerdBuilder) Name() string {
+	return builderContainerd
+}
+
+// EnsureImage ensures that an image is available in containerd, pulling it for
+// the given platform if needed.
+func (b *containerdBuilder) EnsureImage(image, platform string) (*builderImage, error) {
+	matcher, err := platformMatcher(platform)
+	if err != nil {
+		return nil, err
+	}
+
+	_, err = b.client.ImageService().Get(b.ctx, normalizeImageRef(image))
+	if errdefs.IsNotFound(err) {
+		fmt.Printf("Pulling image %s...\n", image)
+		if _, err := b.client.Pull(b.ctx, normalizeImageRef(image), containerd.WithPlatformMatcher(matcher)); err != nil {
+			return nil, fmt.Errorf("failed to pull image %q: %v", image, err)
+		}
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to get image %q: %v", image, err)
+	}
+	return b.inspectImage(image, matcher)
+}
+
+// InspectImage returns an image of containerd for the host platform, or for
+// the platform of the image if it has none for the host, like the VM images
+// built for another platform.
+func (b *containerdBuilder) InspectImage(image string) (*builderImage, error) {
+	return b.inspectImage(image, anyPlatformMatcher{platforms.Default()})
+}
+
+// anyPlatformMatcher matches all the platforms, ordered by the embedded
+// matcher.
+type anyPlatformMatcher struct {
+	platforms.MatchComparer
+}
+
+func (anyPlatformMatcher) Match(specs.Platform) bool {
+	return true
+}
+
+// inspectImage returns an image of containerd for the platforms matched by
+// matcher.
+func (b *containerdBuilder) inspectImage(image string, matcher platforms.MatchComparer) (*builderImage, error) {
+	img, err := b.getImage(image, matcher)
+	if err != nil {
+		return nil, err
+	}
+	configDesc, err := img.Config(b.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the config of image %q: %v", image, err)
+	}
+	config, err := readImageConfig(b.ctx, b.client.ContentStore(), configDesc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the config of image %q: %v", image, err)
+	}
+
+	return &builderImage{
+		ID:       configDesc.Digest.String(),
+		Platform: specs.Platform{OS: config.OS, Architecture: config.Architecture},
+		Labels:   config.Config.Labels,
+	}, nil
+}
+
+// getImage returns a local image of containerd for the platforms matched by
+// matcher.
+func (b *containerdBuilder) getImage(image string, matcher platforms.MatchComparer) (containerd.Image, error) {
+	img, err := b.client.ImageService().Get(b.ctx, normalizeImageRef(image))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %q: %v", image, err)
+	}
+	return containerd.NewImageWithPlatform(b.client, img, matcher), nil
+}
+
+// CreateSandbox creates and starts a privileged containerd container in the
+// host network, to pull the images.
+func (b *containerdBuilder) CreateSandbox(name, image, platform string) (buildSandbox, error) {
+	matcher, err := platformMatcher(platform)
+	if err != nil {
+		return nil, err
+	}
+	img, err := b.getImage(image, matcher)
+	if err != nil {
+		return nil, err
+	}
+
+	// The sandbox snapshot is created from the unpacked image.
+	unpacked, err := img.IsUnpacked(b.ctx, containerd.DefaultSnapshotter)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the snapshot of image %q: %v", image, err)
+	}
+	if !unpacked {
+		fmt.Printf("Unpacking image %s...\n", image)
+		if err := img.Unpack(b.ctx, containerd.DefaultSnapshotter); err != nil {
+			return nil, fmt.Errorf("failed to unpack image %q: %v", image, err)
+		}
+	}
+
+	// The container needs to stay around, run infinite sleep.
+	container, err := b.client.NewContainer(b.ctx, name,
+		containerd.WithSnapshotter(containerd.DefaultSnapshotter),
+		containerd.WithNewSnapshot(name, img),
+		containerd.WithNewSpec(
+			oci.WithImageConfig(img),
+			oci.WithProcessArgs("sleep", "infinity"),
+			oci.WithPrivileged,
+			oci.WithAllDevicesAllowed,
+			oci.WithHostDevices,
+			oci.WithHostNamespace(rspecs.NetworkNamespace),
+			oci.WithHostHostsFile,
+			oci.WithHostResolvconf,
+		),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build container: %v", err)
+	}
+
+	sb := &containerdSandbox{builder: b, container: container, image: img, platform: matcher}
+	if sb.task, err = container.NewTask(b.ctx, cio.NullIO); err == nil {
+		err = sb.task.Start(b.ctx)
+	}
+	if err != nil {
+		sb.Remove()
+		return nil, fmt.Errorf("failed to start build container: %v", err)
+	}
+	return sb, nil
+}
+
+// ListSandboxes returns the build containers of the builder namespace.
+func (b *containerdBuilder) ListSandboxes() ([]sandboxInfo, error) {
+	containers, err := b.client.Containers(b.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build containers: %v", err)
+	}
+
+	var sandboxes []sandboxInfo
+	for _, container := range containers {
+		if !strings.HasPrefix(container.ID(), buildContainerPrefix+"-") {
+			continue
+		}
+		info, err := container.Info(b.ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to get build container %s: %v", container.ID(), err)
+		}
+		sandboxes = append(sandboxes, sandboxInfo{Name: container.ID(), Created: info.CreatedAt})
+	}
+	return sandboxes, nil
+}
+
+// RemoveSandbox removes a build container.
+func (b *containerdBuilder) RemoveSandbox(name string) error {
+	container, err := b.client.LoadContainer(b.ctx, name)
+	if err != nil {
+		return err
+	}
+	return b.removeContainer(container)
+}
+
+// removeContainer kills the task of a container and deletes the container
+// along with its snapshot.
+func (b *containerdBuilder) removeContainer(container containerd.Container) error {
+	task, err := container.Task(b.ctx, nil)
+	if err == nil {
+		if _, err := task.Delete(b.ctx, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			return err
+		}
+	} else if !errdefs.IsNotFound(err) {
+		return err
+	}
+	return container.Delete(b.ctx, containerd.WithSnapshotCleanup)
+}
+
+// PushImage pushes an image of containerd. The localhost registries are
+// pushed to over plain HTTP, like with docker. No progress is printed.
+func (b *containerdBuilder) PushImage(image string, auth *registryAuth, registry string, out io.Writer) (string, error) {
+	img, err := b.client.ImageService().Get(b.ctx, normalizeImageRef(image))
+	if err != nil {
+		return "", fmt.Errorf("failed to get image %q: %v", image, err)
+	}
+
+	authorizer := remotedocker.NewDockerAuthorizer(remotedocker.WithAuthCreds(func(host string) (string, string, error) {
+		if auth == nil || normalizeRegistryHost(host) != registry {
+			return "", "", nil
+		}
+		return auth.Username, auth.Password, nil
+	}))
+	resolver := remotedocker.NewResolver(remotedocker.ResolverOptions{
+		Hosts: remotedocker.ConfigureDefaultRegistries(
+			remotedocker.WithAuthorizer(authorizer),
+			remotedocker.WithPlainHTTP(remotedocker.MatchLocalhost),
+		),
+	})
+
+	if err := b.client.Push(b.ctx, img.Name, img.Target, containerd.WithResolver(resolver)); err != nil {
+		return "", err
+	}
+	return img.Target.Digest.String(), nil
+}
+
+// Close closes the containerd client.
+func (b *containerdBuilder) Close() error {
+	return b.client.Close()
+}
+
+// containerdSandbox is a build sandbox in a containerd container.
+type containerdSandbox struct {
+	builder   *containerdBuilder
+	container containerd.Container
+	task      containerd.Task
+	// image is the image of the container.
+	image containerd.Image
+	// platform matches the platform of the image.
+	platform platforms.MatchComparer
+	// execs is the number of execs, used to create unique exec IDs.
+	execs int64
+}
+
+// Name returns the ID of the build container.
+func (s *containerdSandbox) Name() string {
+	return s.container.ID()
+}
+
+// Exec runs a command in the build container.
+func (s *containerdSandbox) Exec(opts execOptions) (int, error) {
+	ctx := s.builder.ctx
+	pspec, err := s.processSpec(opts.Cmd, opts.Env)
+	if err != nil {
+		return 0, err
+	}
+
+	// Close the process stdin at the end of the input, containerd doesn't.
+	var process containerd.Process
+	started := make(chan struct{})
+	var stdin io.Reader
+	if opts.Stdin != nil {
+		stdin = &eofReader{r: opts.Stdin, onEOF: func() {
+			<-started
+			if process != nil {
+				process.CloseIO(ctx, containerd.WithStdinCloser)
+			}
+		}}
+	}
+	// The stdout and stderr are copied concurrently.
+	output := &syncWriter{w: opts.Output}
+	ioCreator := cio.NewCreator(cio.WithStreams(stdin, output, output))
+
+	process, err = s.task.Exec(ctx, s.nextExecID(), pspec, ioCreator)
+	if err != nil {
+		close(started)
+		return 0, err
+	}
+	defer process.Delete(ctx)
+
+	statusC, err := process.Wait(ctx)
+	if err == nil {
+		err = process.Start(ctx)
+	}
+	close(started)
+	if err != nil {
+		return 0, err
+	}
+
+	status := <-statusC
+	code, _, err := status.Result()
+	// Wait for the output to be copied.
+	process.IO().Wait()
+	return int(code), err
+}
+
+// Start runs a command in the build container in the background, with no IO.
+func (s *containerdSandbox) Start(cmd []string) error {
+	pspec, err := s.processSpec(cmd, nil)
+	if err != nil {
+		return err
+	}
+	process, err := s.task.Exec(s.builder.ctx, s.nextExecID(), pspec, cio.NullIO)
+	if err != nil {
+		return err
+	}
+	return process.Start(s.builder.ctx)
+}
+
+// processSpec returns the spec of a process running cmd in the build
+// container, with the container environment along with env.
+func (s *containerdSandbox) processSpec(cmd, env []string) (*rspecs.Process, error) {
+	spec, err := s.container.Spec(s.builder.ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the spec of build container %s: %v", s.Name(), err)
+	}
+	pspec := *spec.Process
+	pspec.Args = cmd
+	pspec.Env = append(append([]string{}, pspec.Env...), env...)
+	pspec.Terminal = false
+	return &pspec, nil
+}
+
+// nextExecID returns a unique exec ID.
+func (s *containerdSandbox) nextExecID() string {
+	return fmt.Sprintf("exec-%d", atomic.AddInt64(&s.execs, 1))
+}
+
+// Commit creates an image from the build container. The changes of the
+// container snapshot are added as a new layer on top of the container image,
+// or the whole snapshot is the single layer of a squashed image.
+func (s *containerdSandbox) Commit(opts commitOptions) (string, error) {
+	client := s.builder.client
+
+	// Hold the new content until the image references it.
+	ctx, done, err := client.WithLease(s.builder.ctx)
+	if err != nil {
+		return "", err
+	}
+	defer done(s.builder.ctx)
+
+	// Pause the build container for a consistent snapshot, like docker commit.
+	if err := s.task.Pause(ctx); err != nil {
+		return "", fmt.Errorf("failed to pause build container: %v", err)
+	}
+	defer s.task.Resume(s.builder.ctx)
+
+	info, err := s.container.Info(ctx)
+	if err != nil {
+		return "", err
+	}
+	sn := client.SnapshotService(info.Snapshotter)
+	var layer specs.Descriptor
+	if opts.Squash {
+		layer, err = createSquashedDiff(ctx, info.SnapshotKey, sn, client.DiffService())
+	} else {
+		layer, err = rootfs.CreateDiff(ctx, info.SnapshotKey, sn, client.DiffService())
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to create the layer of build container %s: %v", s.Name(), err)
+	}
+	cs := client.ContentStore()
+	layerInfo, err := cs.Info(ctx, layer.Digest)
+	if err != nil {
+		return "", err
+	}
+	diffID, err := digest.Parse(layerInfo.Labels[ctdlabels.LabelUncompressed])
+	if err != nil {
+		return "", fmt.Errorf("invalid uncompressed digest of layer %s: %v", layer.Digest, err)
+	}
+
+	manifest, err := ctdimages.Manifest(ctx, cs, s.image.Target(), s.platform)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the manifest of image %q: %v", s.image.Name(), err)
+	}
+	config, err := readImageConfig(ctx, cs, manifest.Config)
+	if err != nil {
+		return "", fmt.Errorf("failed to read the config of image %q: %v", s.image.Name(), err)
+	}
+
+	created := time.Now().UTC()
+	if opts.Created != nil {
+		created = opts.Created.UTC()
+	}
+	config.Created = &created
+	history := specs.History{Created: &created, CreatedBy: "ignite-cntr commit"}
+	if opts.Squash {
+		config.RootFS.DiffIDs = []digest.Digest{diffID}
+		config.History = []specs.History{history}
+		manifest.Layers = []specs.Descriptor{layer}
+	} else {
+		config.RootFS.DiffIDs = append(config.RootFS.DiffIDs, diffID)
+		config.History = append(config.History, history)
+		manifest.Layers = append(manifest.Layers, layer)
+	}
+	if config.Config.Labels == nil {
+		config.Config.Labels = map[string]string{}
+	}
+	for k, v := range opts.Labels {
+		config.Config.Labels[k] = v
+	}
+	config.Config.Env = mergeEnv(config.Config.Env, opts.Env)
+	configDesc, err := writeJSONBlob(ctx, cs, specs.MediaTypeImageConfig, config, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed to write image config: %v", err)
+	}
+
+	// The GC labels keep the config and layers as long as the manifest.
+	manifest.Config = configDesc
+	gcLabels := map[string]string{"containerd.io/gc.ref.content.config": configDesc.Digest.String()}
+	for i, l := range manifest.Layers {
+		gcLabels[fmt.Sprintf("containerd.io/gc.ref.content.l.%d", i)] = l.Digest.String()
+	}
+	manifestDesc, err := writeJSONBlob(ctx, cs, specs.MediaTypeImageManifest, manifest, gcLabels)
+	if err != nil {
+		return "", fmt.Errorf("failed to write image manifest: %v", err)
+	}
+
+	img := ctdimages.Image{
+		Name:   normalizeImageRef(opts.Ref),
+		Target: manifestDesc,
+	}
+	is := client.ImageService()
+	if _, err := is.Create(ctx, img); errdefs.IsAlreadyExists(err) {
+		_, err = is.Update(ctx, img)
+		if err != nil {
+			return "", fmt.Errorf("failed to update image %q: %v", opts.Ref, err)
+		}
+	} else if err != nil {
+		return "", fmt.Errorf("failed to create image %q: %v", opts.Ref, err)
+	}
+
+	return configDesc.Digest.String(), nil
+}
+
+// Remove removes the build container.
+func (s *containerdSandbox) Remove() error {
+	return s.builder.removeContainer(s.container)
+}
+
+// createSquashedDiff creates a layer of the whole content of a snapshot, by
+// comparing it with an empty view.
+func createSquashedDiff(ctx context.Context, snapshotKey string, sn snapshots.Snapshotter, d diff.Comparer) (specs.Descriptor, error) {
+	// Remove the view even if ctx is canceled.
+	dctx := context.Background()
+	if ns, ok := namespaces.Namespace(ctx); ok {
+		dctx = namespaces.WithNamespace(dctx, ns)
+	}
+
+	emptyKey := fmt.Sprintf("%s-empty-view", snapshotKey)
+	lower, err := sn.View(ctx, emptyKey, "")
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	defer sn.Remove(dctx, emptyKey)
+
+	upper, err := sn.Mounts(ctx, snapshotKey)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	return d.Compare(ctx, lower, upper)
+}
+
+// platformMatcher returns the matcher of the given platform, the host platform
+// if empty.
+func platformMatcher(platform string) (platforms.MatchComparer, error) {
+	if platform == "" {
+		return platforms.Default(), nil
+	}
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return nil, fmt.Errorf("invalid platform %q: %v", platform, err)
+	}
+	return platforms.Only(p), nil
+}
+
+// readImageConfig reads an image config from the content store.
+func readImageConfig(ctx context.Context, provider content.Provider, desc specs.Descriptor) (*specs.Image, error) {
+	data, err := content.ReadBlob(ctx, provider, desc)
+	if err != nil {
+		return nil, err
+	}
+	config := &specs.Image{}
+	if err := json.Unmarshal(data, config); err != nil {
+		return nil, err
+	}
+	return config, nil
+}
+
+// writeJSONBlob writes v in JSON format to the content store with the given
+// media type and content labels, and returns its descriptor.
+func writeJSONBlob(ctx context.Context, cs content.Store, mediaType string, v interface{}, labels map[string]string) (specs.Descriptor, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return specs.Descriptor{}, err
+	}
+	desc := specs.Descriptor{
+		MediaType: mediaType,
+		Digest:    digest.FromBytes(data),
+		Size:      int64(len(data)),
+	}
+	if err := content.WriteBlob(ctx, cs, desc.Digest.String(), bytes.NewReader(data), desc, content.WithLabels(labels)); err != nil {
+		return specs.Descriptor{}, err
+	}
+	return desc, nil
+}
+
+// eofReader calls onEOF once when the underlying reader returns an error,
+// including io.EOF.
+type eofReader struct {
+	r     io.Reader
+	once  sync.Once
+	onEOF func()
+}
+
+// Read reads from the underlying reader.
+func (e *eofReader) Read(b []byte) (int, error) {
+	n, err := e.r.Read(b)
+	if err != nil {
+		e.once.Do(e.onEOF)
+	}
+	return n, err
+}
+
+// syncWriter serializes the writes to the underlying writer.
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// Write writes b to the underlying writer.
+func (s *syncWriter) Write(b []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(b)
+}
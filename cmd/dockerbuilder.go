@@ -0,0 +1,703 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	ctdimages "github.com/containerd/containerd/images"
+	docker "github.com/fsouza/go-dockerclient"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// dockerBuilder builds images with the host docker daemon.
+type dockerBuilder struct {
+	client *docker.Client
+}
+
+// Name returns the name of the builder.
+func (b *dockerBuilder) Name() string {
+	return builderDocker
+}
+
+// EnsureImage ensures that an image is available in the docker daemon, pulling
+// it for the given platform if needed.
+func (b *dockerBuilder) EnsureImage(image, platform string) (*builderImage, error) {
+	_, err := b.client.InspectImage(image)
+	if err == docker.ErrNoSuchImage {
+		fmt.Printf("Pulling image %s...\n", image)
+		repo, tag := docker.ParseRepositoryTag(image)
+		pullOpts := docker.PullImageOptions{
+			Repository: repo,
+			Tag:        tag,
+			Platform:   platform,
+		}
+		if err := b.client.PullImage(pullOpts, docker.AuthConfiguration{}); err != nil {
+			return nil, fmt.Errorf("failed to pull image %q: %v", image, err)
+		}
+	}
+	return b.InspectImage(image)
+}
+
+// InspectImage returns an image of the docker daemon.
+func (b *dockerBuilder) InspectImage(image string) (*builderImage, error) {
+	img, err := b.client.InspectImage(image)
+	if err != nil {
+		return nil, fmt.Errorf("failed to inspect image %q: %v", image, err)
+	}
+	bimg := &builderImage{
+		ID:       img.ID,
+		Platform: specs.Platform{OS: img.OS, Architecture: img.Architecture},
+	}
+	if img.Config != nil {
+		bimg.Labels = img.Config.Labels
+	}
+	return bimg, nil
+}
+
+// CreateSandbox creates and starts a privileged docker container. The image is
+// local, the platform is not used.
+func (b *dockerBuilder) CreateSandbox(name, image, platform string) (buildSandbox, error) {
+	// The container needs to stay around, run infinite sleep.
+	containerOpts := docker.CreateContainerOptions{
+		Name: name,
+		Config: &docker.Config{
+			Image: image,
+			Cmd:   []string{"sleep", "infinity"},
+		},
+		HostConfig: &docker.HostConfig{
+			Privileged: true,
+		},
+	}
+	container, err := b.client.CreateContainer(containerOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create build container: %v", err)
+	}
+
+	sb := &dockerSandbox{client: b.client, container: container}
+	if err := b.client.StartContainer(container.ID, nil); err != nil {
+		sb.Remove()
+		return nil, fmt.Errorf("failed to start build container: %v", err)
+	}
+	return sb, nil
+}
+
+// ListSandboxes returns the build containers of the docker daemon.
+func (b *dockerBuilder) ListSandboxes() ([]sandboxInfo, error) {
+	// The name filter matches substrings, the names are checked for the
+	// prefix below.
+	listOpts := docker.ListContainersOptions{
+		All: true,
+		Filters: map[string][]string{
+			"name": {buildContainerPrefix},
+		},
+	}
+	containers, err := b.client.ListContainers(listOpts)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list build containers: %v", err)
+	}
+
+	var sandboxes []sandboxInfo
+	for _, container := range containers {
+		if name := buildContainerName(container); name != "" {
+			sandboxes = append(sandboxes, sandboxInfo{Name: name, Created: time.Unix(container.Created, 0)})
+		}
+	}
+	return sandboxes, nil
+}
+
+// RemoveSandbox removes a build container.
+func (b *dockerBuilder) RemoveSandbox(name string) error {
+	removeContainerOpts := docker.RemoveContainerOptions{
+		ID:    name,
+		Force: true,
+	}
+	return b.client.RemoveContainer(removeContainerOpts)
+}
+
+// PushImage pushes an image of the docker daemon. The docker daemon pushes to
+// the localhost registries over plain HTTP.
+func (b *dockerBuilder) PushImage(image string, auth *registryAuth, registry string, out io.Writer) (string, error) {
+	var authConfig docker.AuthConfiguration
+	if auth != nil {
+		authConfig = docker.AuthConfiguration{
+			Username:      auth.Username,
+			Password:      auth.Password,
+			ServerAddress: registryServerAddress(registry),
+		}
+	}
+
+	repo, tag := splitImageRef(image)
+	stream := &dockerPushStream{w: out}
+	pushOpts := docker.PushImageOptions{
+		Name:          repo,
+		Tag:           tag,
+		OutputStream:  stream,
+		RawJSONStream: true,
+	}
+	if err := b.client.PushImage(pushOpts, authConfig); err != nil {
+		return "", err
+	}
+	if stream.err != "" {
+		return "", errors.New(stream.err)
+	}
+	if stream.digest == "" {
+		return "", errors.New("docker reported no digest of the pushed image")
+	}
+	return stream.digest, nil
+}
+
+// Close is a no-op, the docker client has no resources to release.
+func (b *dockerBuilder) Close() error {
+	return nil
+}
+
+// buildContainerName returns the name of the container if it's a build
+// container, else an empty string.
+func buildContainerName(container docker.APIContainers) string {
+	for _, name := range container.Names {
+		name = strings.TrimPrefix(name, "/")
+		if strings.HasPrefix(name, buildContainerPrefix+"-") {
+			return name
+		}
+	}
+	return ""
+}
+
+// dockerSandbox is a build sandbox in a docker container.
+type dockerSandbox struct {
+	client    *docker.Client
+	container *docker.Container
+}
+
+// Name returns the name of the build container.
+func (s *dockerSandbox) Name() string {
+	return s.container.Name
+}
+
+// Exec runs a command in the build container.
+func (s *dockerSandbox) Exec(opts execOptions) (int, error) {
+	execOpts := docker.CreateExecOptions{
+		Privileged:   true,
+		Container:    s.container.ID,
+		Cmd:          opts.Cmd,
+		Env:          opts.Env,
+		AttachStdin:  opts.Stdin != nil,
+		AttachStdout: true,
+		AttachStderr: true,
+	}
+	exec, err := s.client.CreateExec(execOpts)
+	if err != nil {
+		return 0, err
+	}
+
+	startOpts := docker.StartExecOptions{
+		InputStream:  opts.Stdin,
+		OutputStream: opts.Output,
+		ErrorStream:  opts.Output,
+	}
+	cw, err := s.client.StartExecNonBlocking(exec.ID, startOpts)
+	if err != nil {
+		return 0, err
+	}
+	defer cw.Close()
+
+	// Wait for the output streams to be closed on exit.
+	if err := cw.Wait(); err != nil {
+		return 0, err
+	}
+
+	inspectRes, err := waitForExec(s.client, exec.ID)
+	if err != nil {
+		return 0, err
+	}
+	return inspectRes.ExitCode, nil
+}
+
+// Start runs a detached command in the build container.
+func (s *dockerSandbox) Start(cmd []string) error {
+	execOpts := docker.CreateExecOptions{
+		Privileged: true,
+		Container:  s.container.ID,
+		Cmd:        cmd,
+	}
+	exec, err := s.client.CreateExec(execOpts)
+	if err != nil {
+		return err
+	}
+	startExecOpts := docker.StartExecOptions{
+		Detach: true,
+	}
+	execCloser, err := s.client.StartExecNonBlocking(exec.ID, startExecOpts)
+	if execCloser != nil {
+		execCloser.Close()
+	}
+	return err
+}
+
+// Commit commits the build container to an image. docker commit sets the
+// creation time of the image, it's rewritten if opts sets one.
+func (s *dockerSandbox) Commit(opts commitOptions) (string, error) {
+	var id string
+	var err error
+	if opts.Squash {
+		id, err = s.commitSquashed(opts)
+	} else {
+		id, err = s.commitContainer(s.container.ID, opts)
+	}
+	if err != nil || opts.Created == nil {
+		return id, err
+	}
+	return setDockerImageCreated(s.client, opts.Ref, *opts.Created)
+}
+
+// commitContainer commits a container to an image. The image gets the config of
+// the container with the labels and environment variables of opts.
+func (s *dockerSandbox) commitContainer(containerID string, opts commitOptions) (string, error) {
+	repo, tag := splitImageRef(opts.Ref)
+	// docker merges the commit config with the container config, the
+	// variables replace the container variables with the same keys.
+	commitOpts := docker.CommitContainerOptions{
+		Container:  containerID,
+		Repository: repo,
+		Tag:        tag,
+		Run: &docker.Config{
+			Labels: opts.Labels,
+			Env:    opts.Env,
+		},
+	}
+	img, err := s.client.CommitContainer(commitOpts)
+	if err != nil {
+		return "", err
+	}
+	return img.ID, nil
+}
+
+// commitSquashed commits the build container to a single layer image. The
+// container filesystem is exported and imported as a temporary image, which
+// gets the config of the container image by committing a container created
+// from it.
+func (s *dockerSandbox) commitSquashed(opts commitOptions) (string, error) {
+	baseImg, err := s.client.InspectImage(s.container.Image)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect the image of build container %s: %v", s.Name(), err)
+	}
+
+	// Pause the build container for a consistent export, like docker commit.
+	if err := s.client.PauseContainer(s.container.ID); err != nil {
+		return "", fmt.Errorf("failed to pause build container: %v", err)
+	}
+	defer s.client.UnpauseContainer(s.container.ID)
+
+	squashRepo := s.Name() + "-squash"
+	pr, pw := io.Pipe()
+	go func() {
+		exportOpts := docker.ExportContainerOptions{
+			ID:           s.container.ID,
+			OutputStream: pw,
+		}
+		pw.CloseWithError(s.client.ExportContainer(exportOpts))
+	}()
+	importOpts := docker.ImportImageOptions{
+		Repository:   squashRepo,
+		Tag:          "latest",
+		Source:       "-",
+		InputStream:  pr,
+		OutputStream: ioutil.Discard,
+	}
+	err = s.client.ImportImage(importOpts)
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", fmt.Errorf("failed to squash build container %s: %v", s.Name(), err)
+	}
+	defer s.client.RemoveImage(squashRepo)
+
+	// The container is not started, it only carries the image config.
+	config := docker.Config{}
+	if baseImg.Config != nil {
+		config = *baseImg.Config
+	}
+	config.Image = squashRepo
+	container, err := s.client.CreateContainer(docker.CreateContainerOptions{Config: &config})
+	if err != nil {
+		return "", fmt.Errorf("failed to create the squashed image container: %v", err)
+	}
+	defer s.client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+
+	return s.commitContainer(container.ID, opts)
+}
+
+// Remove removes the build container.
+func (s *dockerSandbox) Remove() error {
+	removeContainerOpts := docker.RemoveContainerOptions{
+		ID:    s.container.ID,
+		Force: true,
+	}
+	return s.client.RemoveContainer(removeContainerOpts)
+}
+
+// waitForExec waits for an exec to stop running and returns the final exec
+// state.
+func waitForExec(client *docker.Client, execID string) (*docker.ExecInspect, error) {
+	for {
+		inspectRes, err := client.InspectExec(execID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to inspect exec: %v", err)
+		}
+
+		if !inspectRes.Running {
+			return inspectRes, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// setDockerImageCreated sets the creation time of an image of the docker daemon
+// and returns the new image ID. The image is saved and loaded back with its
+// config rewritten by rewriteImageConfig. The image ID is the digest of the
+// config, the image gets the same ID from the same layers.
+func setDockerImageCreated(client *docker.Client, ref string, created time.Time) (string, error) {
+	oldImg, err := client.InspectImage(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %q: %v", ref, err)
+	}
+
+	saved, savedW := io.Pipe()
+	go func() {
+		exportOpts := docker.ExportImageOptions{Name: ref, OutputStream: savedW}
+		savedW.CloseWithError(client.ExportImage(exportOpts))
+	}()
+	loaded, loadedW := io.Pipe()
+	go func() {
+		err := rewriteSavedImage(saved, loadedW, created)
+		// Unblock the export if the rewrite failed before reading everything.
+		saved.CloseWithError(err)
+		loadedW.CloseWithError(err)
+	}()
+	err = client.LoadImage(docker.LoadImageOptions{InputStream: loaded, OutputStream: ioutil.Discard})
+	loaded.CloseWithError(err)
+	if err != nil {
+		return "", fmt.Errorf("failed to set the creation time of image %q: %v", ref, err)
+	}
+
+	img, err := client.InspectImage(ref)
+	if err != nil {
+		return "", fmt.Errorf("failed to inspect image %q: %v", ref, err)
+	}
+	if img.ID != oldImg.ID {
+		// The old image is left untagged. It may be used by containers, the
+		// removal is best effort.
+		client.RemoveImage(oldImg.ID)
+	}
+	return img.ID, nil
+}
+
+// maxSavedJSONSize is the maximum size of the JSON files of a docker save
+// archive held by rewriteSavedImage, the larger files are layers.
+const maxSavedJSONSize = 4 << 20
+
+// rewriteSavedImage copies a docker save image archive from r to w, with the
+// image configs rewritten by rewriteImageConfig. It supports the legacy layout,
+// with the configs named <hex>.json and listed in manifest.json, and the OCI
+// layout of docker 25 and later, with the configs in blobs/sha256 referenced
+// by digest from the OCI manifests, index.json and manifest.json. The JSON
+// files are held until the end of the archive to update the references, the
+// layers are copied as is. docker load doesn't depend on the order of the
+// files.
+func rewriteSavedImage(r io.Reader, w io.Writer, created time.Time) error {
+	tr := tar.NewReader(r)
+	tw := tar.NewWriter(w)
+	archive := &savedImageArchive{files: map[string]*savedFile{}, renamed: map[string]string{}}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		if hdr.Typeflag == tar.TypeReg && hdr.Size <= maxSavedJSONSize && isSavedJSONName(hdr.Name) {
+			data, err := ioutil.ReadAll(tr)
+			if err != nil {
+				return err
+			}
+			if json.Valid(data) {
+				archive.files[hdr.Name] = &savedFile{hdr: hdr, data: data}
+				continue
+			}
+			if err := writeTarFile(tw, hdr, data); err != nil {
+				return err
+			}
+			continue
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+
+	if err := archive.rewrite(created); err != nil {
+		return err
+	}
+	names := make([]string, 0, len(archive.files))
+	for name := range archive.files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		f := archive.files[name]
+		if err := writeTarFile(tw, f.hdr, f.data); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
+
+// isSavedJSONName returns true if a file of a docker save archive may be an
+// image config, a manifest or an index: a top level JSON file or an OCI blob.
+func isSavedJSONName(name string) bool {
+	if strings.HasPrefix(name, "blobs/") {
+		return true
+	}
+	return !strings.Contains(name, "/") && strings.HasSuffix(name, ".json")
+}
+
+// writeTarFile writes a file with the given header and data, the header size
+// is set to the data size.
+func writeTarFile(tw *tar.Writer, hdr *tar.Header, data []byte) error {
+	hdr.Size = int64(len(data))
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(data)
+	return err
+}
+
+// savedFile is a file of a docker save archive held in memory.
+type savedFile struct {
+	hdr  *tar.Header
+	data []byte
+}
+
+// savedImageArchive is the JSON files of a docker save archive, keyed by path.
+type savedImageArchive struct {
+	files map[string]*savedFile
+	// renamed are the new paths of the rewritten files.
+	renamed map[string]string
+	created time.Time
+}
+
+// rewrite rewrites the image configs and updates their references, the OCI
+// manifests and indexes referencing them are renamed by their new digests.
+func (a *savedImageArchive) rewrite(created time.Time) error {
+	a.created = created
+	if f, ok := a.files["index.json"]; ok {
+		data, err := a.rewriteIndex(f.data)
+		if err != nil {
+			return fmt.Errorf("invalid image archive index.json: %v", err)
+		}
+		f.data = data
+	}
+
+	f, ok := a.files["manifest.json"]
+	if !ok {
+		return errors.New("invalid image archive, no manifest.json")
+	}
+	var manifest []map[string]interface{}
+	if err := json.Unmarshal(f.data, &manifest); err != nil {
+		return fmt.Errorf("invalid image archive manifest: %v", err)
+	}
+	for _, m := range manifest {
+		config, ok := m["Config"].(string)
+		if !ok {
+			return errors.New("invalid image archive manifest, no image config")
+		}
+		newConfig, err := a.rewriteConfig(config)
+		if err != nil {
+			return err
+		}
+		m["Config"] = newConfig
+	}
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return err
+	}
+	f.data = data
+	return nil
+}
+
+// rewriteConfig rewrites the image config at name and returns its new name,
+// after its new digest. A config is rewritten once.
+func (a *savedImageArchive) rewriteConfig(name string) (string, error) {
+	if newName, ok := a.renamed[name]; ok {
+		return newName, nil
+	}
+	f, ok := a.files[name]
+	if !ok {
+		return "", fmt.Errorf("invalid image archive, image config %s not found", name)
+	}
+	data, err := rewriteImageConfig(f.data, a.created)
+	if err != nil {
+		return "", fmt.Errorf("invalid image config %s: %v", name, err)
+	}
+	dgst := digest.FromBytes(data)
+	newName := dgst.Hex() + ".json"
+	if strings.HasPrefix(name, "blobs/") {
+		newName = savedBlobPath(dgst)
+	}
+	a.replace(name, newName, data)
+	return newName, nil
+}
+
+// rewriteBlob rewrites the OCI blob of a descriptor and updates the descriptor
+// digest and size. The configs are rewritten, and the manifests and indexes
+// updated with their rewritten blobs. The blobs missing in the archive, like
+// the manifests of the other platforms of an index, are left as is.
+func (a *savedImageArchive) rewriteBlob(desc map[string]interface{}, isConfig bool) error {
+	dgstStr, _ := desc["digest"].(string)
+	dgst, err := digest.Parse(dgstStr)
+	if err != nil {
+		return fmt.Errorf("invalid descriptor digest %q: %v", dgstStr, err)
+	}
+	name := savedBlobPath(dgst)
+	f, ok := a.files[name]
+	if !ok {
+		if _, renamed := a.renamed[name]; !renamed {
+			return nil
+		}
+	}
+
+	var newName string
+	switch mediaType, _ := desc["mediaType"].(string); {
+	case isConfig:
+		if newName, err = a.rewriteConfig(name); err != nil {
+			return err
+		}
+	case mediaType == specs.MediaTypeImageIndex || mediaType == ctdimages.MediaTypeDockerSchema2ManifestList:
+		if newName, ok = a.renamed[name]; !ok {
+			data, err := a.rewriteIndex(f.data)
+			if err != nil {
+				return fmt.Errorf("invalid image index %s: %v", name, err)
+			}
+			newName = savedBlobPath(digest.FromBytes(data))
+			a.replace(name, newName, data)
+		}
+	case mediaType == specs.MediaTypeImageManifest || mediaType == ctdimages.MediaTypeDockerSchema2Manifest:
+		if newName, ok = a.renamed[name]; !ok {
+			data, err := a.rewriteManifest(f.data)
+			if err != nil {
+				return fmt.Errorf("invalid image manifest %s: %v", name, err)
+			}
+			newName = savedBlobPath(digest.FromBytes(data))
+			a.replace(name, newName, data)
+		}
+	default:
+		return nil
+	}
+
+	newFile := a.files[newName]
+	desc["digest"] = digest.FromBytes(newFile.data).String()
+	desc["size"] = len(newFile.data)
+	return nil
+}
+
+// rewriteIndex returns an OCI index with its manifests rewritten.
+func (a *savedImageArchive) rewriteIndex(data []byte) ([]byte, error) {
+	index, err := decodeJSONObject(data)
+	if err != nil {
+		return nil, err
+	}
+	manifests, _ := index["manifests"].([]interface{})
+	for _, m := range manifests {
+		desc, ok := m.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("invalid manifest descriptor")
+		}
+		if err := a.rewriteBlob(desc, false); err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(index)
+}
+
+// rewriteManifest returns an OCI manifest with its config rewritten.
+func (a *savedImageArchive) rewriteManifest(data []byte) ([]byte, error) {
+	manifest, err := decodeJSONObject(data)
+	if err != nil {
+		return nil, err
+	}
+	config, ok := manifest["config"].(map[string]interface{})
+	if !ok {
+		return nil, errors.New("no config descriptor")
+	}
+	if err := a.rewriteBlob(config, true); err != nil {
+		return nil, err
+	}
+	return json.Marshal(manifest)
+}
+
+// replace replaces the file at name with a file at newName with the given data.
+func (a *savedImageArchive) replace(name, newName string, data []byte) {
+	f := a.files[name]
+	delete(a.files, name)
+	hdr := *f.hdr
+	hdr.Name = newName
+	a.files[newName] = &savedFile{hdr: &hdr, data: data}
+	a.renamed[name] = newName
+}
+
+// savedBlobPath returns the path of an OCI blob in a docker save archive.
+func savedBlobPath(dgst digest.Digest) string {
+	return path.Join("blobs", dgst.Algorithm().String(), dgst.Hex())
+}
+
+// decodeJSONObject decodes a JSON object, keeping the numbers as is.
+func decodeJSONObject(data []byte) (map[string]interface{}, error) {
+	var v map[string]interface{}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// rewriteImageConfig sets the creation time of a docker image config, clamps
+// the later history entries to it, like the SOURCE_DATE_EPOCH builds, and
+// removes the fields of the build container, which has a random ID.
+func rewriteImageConfig(data []byte, created time.Time) ([]byte, error) {
+	config, err := decodeJSONObject(data)
+	if err != nil {
+		return nil, err
+	}
+
+	createdStr := created.UTC().Format(time.RFC3339Nano)
+	config["created"] = createdStr
+	delete(config, "container")
+	delete(config, "container_config")
+	history, _ := config["history"].([]interface{})
+	for _, h := range history {
+		entry, ok := h.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		s, _ := entry["created"].(string)
+		if t, err := time.Parse(time.RFC3339Nano, s); err != nil || t.After(created) {
+			entry["created"] = createdStr
+		}
+	}
+	return json.Marshal(config)
+}
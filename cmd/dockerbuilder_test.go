@@ -0,0 +1,334 @@
+package cmd
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	ctdimages "github.com/containerd/containerd/images"
+	digest "github.com/opencontainers/go-digest"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+)
+
+// savedImageFixture is the files of a docker save archive of one image with
+// one layer.
+type savedImageFixture struct {
+	files map[string][]byte
+	layer []byte
+}
+
+// newSavedImageConfig returns the config of the fixture image, built at
+// 2021-01-02 in a container, with a history entry of the build and one of the
+// epoch.
+func newSavedImageConfig(t *testing.T, layer []byte) []byte {
+	return mustMarshal(t, map[string]interface{}{
+		"architecture":     "amd64",
+		"os":               "linux",
+		"created":          "2021-01-02T03:04:05.123456789Z",
+		"container":        "2f2e0ef7cd1c",
+		"container_config": map[string]interface{}{"Hostname": "2f2e0ef7cd1c"},
+		"config":           map[string]interface{}{"Labels": map[string]string{"a": "b"}},
+		"rootfs":           map[string]interface{}{"type": "layers", "diff_ids": []string{digest.FromBytes(layer).String()}},
+		"history": []map[string]interface{}{
+			{"created": "1970-01-01T00:00:00Z", "created_by": "base"},
+			{"created": "2021-01-02T03:04:05.123456789Z", "created_by": "build"},
+		},
+	})
+}
+
+// newOCISavedImage returns the archive files written by docker save 25 and
+// later: an OCI layout with a docker manifest.json.
+func newOCISavedImage(t *testing.T) savedImageFixture {
+	layer := newLayerTar(t)
+	config := newSavedImageConfig(t, layer)
+	manifest := mustMarshal(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     specs.MediaTypeImageManifest,
+		"config":        map[string]interface{}{"mediaType": specs.MediaTypeImageConfig, "digest": digest.FromBytes(config), "size": len(config)},
+		"layers":        []map[string]interface{}{{"mediaType": specs.MediaTypeImageLayer, "digest": digest.FromBytes(layer), "size": len(layer)}},
+	})
+	index := mustMarshal(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"mediaType":     specs.MediaTypeImageIndex,
+		"manifests": []map[string]interface{}{{
+			"mediaType":   specs.MediaTypeImageManifest,
+			"digest":      digest.FromBytes(manifest),
+			"size":        len(manifest),
+			"annotations": map[string]string{"io.containerd.image.name": "docker.io/library/foo:latest"},
+		}},
+	})
+	return savedImageFixture{
+		layer: layer,
+		files: map[string][]byte{
+			savedBlobPath(digest.FromBytes(layer)):    layer,
+			savedBlobPath(digest.FromBytes(config)):   config,
+			savedBlobPath(digest.FromBytes(manifest)): manifest,
+			"index.json": index,
+			"manifest.json": mustMarshal(t, []map[string]interface{}{{
+				"Config":   savedBlobPath(digest.FromBytes(config)),
+				"RepoTags": []string{"foo:latest"},
+				"Layers":   []string{savedBlobPath(digest.FromBytes(layer))},
+			}}),
+			"oci-layout":   []byte(`{"imageLayoutVersion":"1.0.0"}`),
+			"repositories": []byte(`{"foo":{"latest":"abc"}}`),
+		},
+	}
+}
+
+// newLegacySavedImage returns the archive files written by docker save before
+// 25.
+func newLegacySavedImage(t *testing.T) savedImageFixture {
+	layer := newLayerTar(t)
+	config := newSavedImageConfig(t, layer)
+	return savedImageFixture{
+		layer: layer,
+		files: map[string][]byte{
+			digest.FromBytes(config).Hex() + ".json": config,
+			"0123abcd/VERSION":                       []byte("1.0"),
+			"0123abcd/json":                          []byte(`{"id":"0123abcd"}`),
+			"0123abcd/layer.tar":                     layer,
+			"manifest.json": mustMarshal(t, []map[string]interface{}{{
+				"Config":   digest.FromBytes(config).Hex() + ".json",
+				"RepoTags": []string{"foo:latest"},
+				"Layers":   []string{"0123abcd/layer.tar"},
+			}}),
+			"repositories": []byte(`{"foo":{"latest":"0123abcd"}}`),
+		},
+	}
+}
+
+func TestRewriteSavedImage(t *testing.T) {
+	created := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	tests := []struct {
+		name    string
+		fixture savedImageFixture
+		oci     bool
+	}{
+		{name: "OCI layout", fixture: newOCISavedImage(t), oci: true},
+		{name: "legacy layout", fixture: newLegacySavedImage(t)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if err := rewriteSavedImage(bytes.NewReader(writeArchive(t, tt.fixture.files)), &out, created); err != nil {
+				t.Fatal(err)
+			}
+			files := readArchive(t, out.Bytes())
+
+			// manifest.json references the rewritten config, named by its
+			// digest.
+			var manifest []struct {
+				Config string
+				Layers []string
+			}
+			if err := json.Unmarshal(files["manifest.json"], &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if len(manifest) != 1 {
+				t.Fatalf("got %d manifest.json entries, want 1", len(manifest))
+			}
+			configData, ok := files[manifest[0].Config]
+			if !ok {
+				t.Fatalf("config %s not found in the archive", manifest[0].Config)
+			}
+			configDigest := digest.FromBytes(configData)
+			wantConfigName := configDigest.Hex() + ".json"
+			if tt.oci {
+				wantConfigName = savedBlobPath(configDigest)
+			}
+			if manifest[0].Config != wantConfigName {
+				t.Errorf("got config %s, want %s", manifest[0].Config, wantConfigName)
+			}
+			checkRewrittenConfig(t, configData)
+			for _, l := range manifest[0].Layers {
+				if !bytes.Equal(files[l], tt.fixture.layer) {
+					t.Errorf("layer %s changed", l)
+				}
+			}
+			if len(files) != len(tt.fixture.files) {
+				t.Errorf("got files %v, want %d files", fileNames(files), len(tt.fixture.files))
+			}
+			if !tt.oci {
+				return
+			}
+
+			// index.json references the rewritten manifest, which references
+			// the rewritten config.
+			var index specs.Index
+			if err := json.Unmarshal(files["index.json"], &index); err != nil {
+				t.Fatal(err)
+			}
+			if len(index.Manifests) != 1 {
+				t.Fatalf("got %d index manifests, want 1", len(index.Manifests))
+			}
+			desc := index.Manifests[0]
+			checkDescriptor(t, files, desc)
+			if got := desc.Annotations["io.containerd.image.name"]; got != "docker.io/library/foo:latest" {
+				t.Errorf("got image name annotation %q, want docker.io/library/foo:latest", got)
+			}
+			var ociManifest specs.Manifest
+			if err := json.Unmarshal(files[savedBlobPath(desc.Digest)], &ociManifest); err != nil {
+				t.Fatal(err)
+			}
+			checkDescriptor(t, files, ociManifest.Config)
+			if ociManifest.Config.Digest != configDigest {
+				t.Errorf("got manifest config %s, want %s", ociManifest.Config.Digest, configDigest)
+			}
+			if len(ociManifest.Layers) != 1 || ociManifest.Layers[0].Digest != digest.FromBytes(tt.fixture.layer) {
+				t.Errorf("got manifest layers %+v, want the fixture layer", ociManifest.Layers)
+			}
+		})
+	}
+}
+
+func TestRewriteSavedImageManifestList(t *testing.T) {
+	// An index.json referencing an index, with a manifest of another
+	// platform missing in the archive.
+	fixture := newOCISavedImage(t)
+	var index map[string]interface{}
+	if err := json.Unmarshal(fixture.files["index.json"], &index); err != nil {
+		t.Fatal(err)
+	}
+	missing := map[string]interface{}{"mediaType": ctdimages.MediaTypeDockerSchema2Manifest, "digest": digest.FromString("arm64"), "size": 10}
+	index["mediaType"] = ctdimages.MediaTypeDockerSchema2ManifestList
+	index["manifests"] = append(index["manifests"].([]interface{}), missing)
+	list := mustMarshal(t, index)
+	fixture.files[savedBlobPath(digest.FromBytes(list))] = list
+	fixture.files["index.json"] = mustMarshal(t, map[string]interface{}{
+		"schemaVersion": 2,
+		"manifests":     []map[string]interface{}{{"mediaType": ctdimages.MediaTypeDockerSchema2ManifestList, "digest": digest.FromBytes(list), "size": len(list)}},
+	})
+
+	var out bytes.Buffer
+	created := time.Date(2020, 5, 6, 7, 8, 9, 0, time.UTC)
+	if err := rewriteSavedImage(bytes.NewReader(writeArchive(t, fixture.files)), &out, created); err != nil {
+		t.Fatal(err)
+	}
+	files := readArchive(t, out.Bytes())
+
+	var top specs.Index
+	if err := json.Unmarshal(files["index.json"], &top); err != nil {
+		t.Fatal(err)
+	}
+	checkDescriptor(t, files, top.Manifests[0])
+	var rewritten specs.Index
+	if err := json.Unmarshal(files[savedBlobPath(top.Manifests[0].Digest)], &rewritten); err != nil {
+		t.Fatal(err)
+	}
+	if len(rewritten.Manifests) != 2 {
+		t.Fatalf("got %d manifests, want 2", len(rewritten.Manifests))
+	}
+	checkDescriptor(t, files, rewritten.Manifests[0])
+	if got := rewritten.Manifests[1].Digest; got != digest.FromString("arm64") {
+		t.Errorf("got missing manifest digest %s, want it unchanged", got)
+	}
+	var ociManifest specs.Manifest
+	if err := json.Unmarshal(files[savedBlobPath(rewritten.Manifests[0].Digest)], &ociManifest); err != nil {
+		t.Fatal(err)
+	}
+	checkDescriptor(t, files, ociManifest.Config)
+	checkRewrittenConfig(t, files[savedBlobPath(ociManifest.Config.Digest)])
+}
+
+// checkRewrittenConfig checks that a config rewritten with the creation time
+// 2020-05-06T07:08:09Z has no build container fields and the later history
+// entries clamped.
+func checkRewrittenConfig(t *testing.T, data []byte) {
+	t.Helper()
+	var config map[string]interface{}
+	if err := json.Unmarshal(data, &config); err != nil {
+		t.Fatal(err)
+	}
+	if got := config["created"]; got != "2020-05-06T07:08:09Z" {
+		t.Errorf("got created %v, want 2020-05-06T07:08:09Z", got)
+	}
+	if _, ok := config["container"]; ok {
+		t.Error("got container, want none")
+	}
+	if _, ok := config["container_config"]; ok {
+		t.Error("got container_config, want none")
+	}
+	var history []string
+	for _, h := range config["history"].([]interface{}) {
+		history = append(history, h.(map[string]interface{})["created"].(string))
+	}
+	if want := []string{"1970-01-01T00:00:00Z", "2020-05-06T07:08:09Z"}; !reflect.DeepEqual(history, want) {
+		t.Errorf("got history times %v, want %v", history, want)
+	}
+}
+
+// checkDescriptor checks that the blob of a descriptor is in the archive with
+// the descriptor digest and size.
+func checkDescriptor(t *testing.T, files map[string][]byte, desc specs.Descriptor) {
+	t.Helper()
+	data, ok := files[savedBlobPath(desc.Digest)]
+	if !ok {
+		t.Fatalf("blob %s not found in the archive", desc.Digest)
+	}
+	if got := digest.FromBytes(data); got != desc.Digest {
+		t.Errorf("got blob digest %s, want %s", got, desc.Digest)
+	}
+	if int64(len(data)) != desc.Size {
+		t.Errorf("got blob size %d, want %d", len(data), desc.Size)
+	}
+}
+
+func newLayerTar(t *testing.T) []byte {
+	return writeArchive(t, map[string][]byte{"etc/hostname": []byte("vm\n")})
+}
+
+// writeArchive returns a tar of the given files, in lexical order like docker
+// save.
+func writeArchive(t *testing.T, files map[string][]byte) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range fileNames(files) {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(files[name])), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(files[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func readArchive(t *testing.T, data []byte) map[string][]byte {
+	files := map[string][]byte{}
+	tr := tar.NewReader(bytes.NewReader(data))
+	for {
+		hdr, err := tr.Next()
+		if err != nil {
+			break
+		}
+		if files[hdr.Name], err = ioutil.ReadAll(tr); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return files
+}
+
+func fileNames(files map[string][]byte) []string {
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
@@ -0,0 +1,336 @@
+package cmd
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// vmDockerfile is the path of a Dockerfile snippet applied on top of the
+	// base image of a VM image.
+	vmDockerfile string
+	// vmDockerfileContext is the build context directory of the Dockerfile
+	// snippet.
+	vmDockerfileContext string
+)
+
+// continuationRegexp matches the line continuation character at the end of a
+// Dockerfile line, which can be followed by whitespace.
+var continuationRegexp = regexp.MustCompile(`\\[ \t]*$`)
+
+// dockerfileStep is an instruction of a Dockerfile snippet.
+type dockerfileStep struct {
+	// Line is the line number of the instruction, for the errors.
+	Line int
+	// Instruction is the uppercase instruction name.
+	Instruction string
+	// Args is the raw arguments of the instruction.
+	Args string
+	// JSON are the arguments of the JSON form of the instruction, nil for the
+	// shell form.
+	JSON []string
+}
+
+// String returns the instruction as written in the Dockerfile.
+func (s dockerfileStep) String() string {
+	return fmt.Sprintf("%s %s", s.Instruction, s.Args)
+}
+
+// readDockerfileSnippet reads and parses a Dockerfile snippet file.
+func readDockerfileSnippet(file string) ([]dockerfileStep, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read Dockerfile %q: %v", file, err)
+	}
+	defer f.Close()
+
+	steps, err := parseDockerfileSnippet(f)
+	if err != nil {
+		return nil, fmt.Errorf("invalid Dockerfile %q: %v", file, err)
+	}
+	return steps, nil
+}
+
+// parseDockerfileSnippet parses the instructions of a Dockerfile snippet. The
+// snippet is applied on top of an image, it has no FROM. Only the RUN, COPY
+// and ENV instructions are supported, they are run in the build sandbox.
+func parseDockerfileSnippet(r io.Reader) ([]dockerfileStep, error) {
+	var steps []dockerfileStep
+	var step strings.Builder
+	startLine := 0
+
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := scanner.Text()
+		// Comments and empty lines are also skipped in continued lines.
+		if trimmed := strings.TrimSpace(line); trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		// Like docker, the continued lines are joined as is, without the
+		// continuation character.
+		if step.Len() == 0 {
+			startLine = lineNum
+			line = strings.TrimLeft(line, " \t")
+		}
+		if loc := continuationRegexp.FindStringIndex(line); loc != nil {
+			step.WriteString(line[:loc[0]])
+			continue
+		}
+		step.WriteString(line)
+
+		s, err := parseDockerfileStep(startLine, strings.TrimSpace(step.String()))
+		if err != nil {
+			return nil, err
+		}
+		steps = append(steps, s)
+		step.Reset()
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if step.Len() > 0 {
+		return nil, fmt.Errorf("line %d: unterminated line continuation", startLine)
+	}
+	return steps, nil
+}
+
+// parseDockerfileStep parses an instruction line.
+func parseDockerfileStep(lineNum int, line string) (dockerfileStep, error) {
+	instruction, args := line, ""
+	if i := strings.IndexAny(line, " \t"); i >= 0 {
+		instruction, args = line[:i], strings.TrimSpace(line[i:])
+	}
+	s := dockerfileStep{Line: lineNum, Instruction: strings.ToUpper(instruction), Args: args}
+	if s.Args == "" {
+		return s, fmt.Errorf("line %d: %s has no arguments", lineNum, s.Instruction)
+	}
+
+	switch s.Instruction {
+	case "RUN", "COPY":
+		if strings.HasPrefix(s.Args, "[") {
+			if err := json.Unmarshal([]byte(s.Args), &s.JSON); err != nil {
+				return s, fmt.Errorf("line %d: invalid JSON form of %s: %v", lineNum, s.Instruction, err)
+			}
+		}
+		if s.Instruction == "COPY" {
+			if strings.HasPrefix(s.Args, "--") {
+				return s, fmt.Errorf("line %d: COPY flags are not supported", lineNum)
+			}
+			if len(s.copyArgs()) < 2 {
+				return s, fmt.Errorf("line %d: COPY needs a source and a destination", lineNum)
+			}
+		}
+	case "ENV":
+		if _, err := s.envVars(); err != nil {
+			return s, fmt.Errorf("line %d: %v", lineNum, err)
+		}
+	case "FROM":
+		return s, fmt.Errorf("line %d: FROM is not allowed, the snippet is applied on top of the base image", lineNum)
+	default:
+		return s, fmt.Errorf("line %d: unsupported instruction %s, want RUN, COPY or ENV", lineNum, s.Instruction)
+	}
+	return s, nil
+}
+
+// copyArgs returns the sources and destination of a COPY instruction.
+func (s dockerfileStep) copyArgs() []string {
+	if s.JSON != nil {
+		return s.JSON
+	}
+	return strings.Fields(s.Args)
+}
+
+// envVars returns the variables of an ENV instruction in KEY=value format.
+// Both the ENV KEY=value... and the ENV KEY value forms are supported. Like
+// docker, the values can be quoted, and the quotes and backslash escapes are
+// removed. The variable references aren't expanded.
+func (s dockerfileStep) envVars() ([]string, error) {
+	args := strings.TrimSpace(s.Args)
+	if key := strings.Fields(args)[0]; !strings.Contains(key, "=") {
+		// The value is the rest of the line after the first run of
+		// whitespace.
+		rest := strings.TrimSpace(args[len(key):])
+		if rest == "" {
+			return nil, fmt.Errorf("ENV %s has no value", s.Args)
+		}
+		value, err := shellWords(rest, false)
+		if err != nil {
+			return nil, err
+		}
+		return []string{key + "=" + value[0]}, nil
+	}
+
+	words, err := shellWords(s.Args, true)
+	if err != nil {
+		return nil, err
+	}
+	var vars []string
+	for _, word := range words {
+		kv := strings.SplitN(word, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("invalid ENV variable %q, want KEY=value", word)
+		}
+		vars = append(vars, word)
+	}
+	return vars, nil
+}
+
+// shellWords removes the quotes and backslash escapes of s, like the shell. If
+// split is set, s is split into words at the unquoted whitespace, else the
+// whitespace is kept and a single word returned.
+func shellWords(s string, split bool) ([]string, error) {
+	var words []string
+	var word strings.Builder
+	inWord := false
+	var quote rune
+	escaped := false
+	for _, c := range s {
+		switch {
+		case escaped:
+			// In double quotes, the backslash only escapes " and \.
+			if quote == '"' && c != '"' && c != '\\' {
+				word.WriteRune('\\')
+			}
+			word.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				word.WriteRune(c)
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case split && (c == ' ' || c == '\t'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+			continue
+		default:
+			word.WriteRune(c)
+		}
+		inWord = true
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", s)
+	}
+	if escaped {
+		word.WriteRune('\\')
+	}
+	if inWord || !split {
+		words = append(words, word.String())
+	}
+	return words, nil
+}
+
+// applyDockerfileSnippet runs the steps of a Dockerfile snippet in the build
+// sandbox, printing the output of the RUN steps to out. The COPY sources are
+// read from contextDir. It returns the variables of the ENV steps, to be set
+// in the image config.
+func applyDockerfileSnippet(sb buildSandbox, steps []dockerfileStep, contextDir string, out io.Writer) ([]string, error) {
+	var env []string
+	for i, step := range steps {
+		fmt.Fprintf(out, "Step %d/%d : %s\n", i+1, len(steps), step)
+
+		switch step.Instruction {
+		case "RUN":
+			cmd := step.JSON
+			if cmd == nil {
+				cmd = []string{"sh", "-c", step.Args}
+			}
+			if _, err := execInSandbox(sb, execOptions{Cmd: cmd, Env: env, Output: out}); err != nil {
+				return nil, fmt.Errorf("line %d: failed to run %q: %v", step.Line, step.Args, err)
+			}
+		case "COPY":
+			destIsDir, err := sandboxIsDir(sb, step.copyDest())
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", step.Line, err)
+			}
+			files, err := copyStepFiles(step, contextDir, destIsDir)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", step.Line, err)
+			}
+			for _, file := range files {
+				if err := copyToSandbox(sb, file, nil); err != nil {
+					return nil, fmt.Errorf("line %d: failed to copy %q: %v", step.Line, file.Src, err)
+				}
+			}
+		case "ENV":
+			vars, err := step.envVars()
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %v", step.Line, err)
+			}
+			env = append(env, vars...)
+		}
+	}
+	return env, nil
+}
+
+// sandboxIsDir returns true if path is a directory in the build sandbox.
+func sandboxIsDir(sb buildSandbox, path string) (bool, error) {
+	code, err := sb.Exec(execOptions{Cmd: []string{"test", "-d", path}, Output: ioutil.Discard})
+	if err != nil {
+		return false, err
+	}
+	return code == 0, nil
+}
+
+// copyDest returns the absolute destination of a COPY step.
+func (s dockerfileStep) copyDest() string {
+	args := s.copyArgs()
+	dest := args[len(args)-1]
+	if !path.IsAbs(dest) {
+		dest = "/" + dest
+	}
+	return dest
+}
+
+// copyStepFiles returns the files copied by a COPY step. Like docker, the
+// contents of the source directories are copied into the destination, and
+// the source files are copied into the destination directory if it ends with
+// a slash, is an existing directory, destIsDir, or there are several sources.
+func copyStepFiles(step dockerfileStep, contextDir string, destIsDir bool) ([]fileSpec, error) {
+	args := step.copyArgs()
+	dest := step.copyDest()
+
+	var srcs []string
+	for _, pattern := range args[:len(args)-1] {
+		// The sources can't leave the context.
+		clean := filepath.Clean(string(filepath.Separator) + pattern)
+		matches, err := filepath.Glob(filepath.Join(contextDir, clean))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			return nil, fmt.Errorf("no source files were specified by %q in context %q", pattern, contextDir)
+		}
+		srcs = append(srcs, matches...)
+	}
+
+	intoDir := strings.HasSuffix(dest, "/") || destIsDir || len(srcs) > 1
+	var files []fileSpec
+	for _, src := range srcs {
+		info, err := os.Stat(src)
+		if err != nil {
+			return nil, err
+		}
+		file := fileSpec{Src: src, Dest: dest}
+		if !info.IsDir() && intoDir {
+			file.Dest = path.Join(dest, filepath.Base(src))
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
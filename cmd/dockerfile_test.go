@@ -0,0 +1,213 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseDockerfileSnippet(t *testing.T) {
+	tests := []struct {
+		name      string
+		snippet   string
+		wantSteps []string
+		wantErr   bool
+	}{
+		{
+			name:      "instructions",
+			snippet:   "RUN apt-get update\nenv A=1\nCOPY a /a\n",
+			wantSteps: []string{"RUN apt-get update", "ENV A=1", "COPY a /a"},
+		},
+		{
+			name:      "comments and empty lines",
+			snippet:   "# comment\n\n  RUN true\n",
+			wantSteps: []string{"RUN true"},
+		},
+		{
+			name:      "continuation keeps the whitespace",
+			snippet:   "RUN apt-get update && \\\n    apt-get install -y curl\n",
+			wantSteps: []string{"RUN apt-get update &&     apt-get install -y curl"},
+		},
+		{
+			name:      "continuation adds no space",
+			snippet:   "RUN echo a\\\nb\n",
+			wantSteps: []string{"RUN echo ab"},
+		},
+		{
+			name:      "continuation with trailing whitespace",
+			snippet:   "RUN echo a \\  \nb\n",
+			wantSteps: []string{"RUN echo a b"},
+		},
+		{
+			name:      "comment in continuation",
+			snippet:   "RUN echo a \\\n# comment\nb\n",
+			wantSteps: []string{"RUN echo a b"},
+		},
+		{
+			name:    "unterminated continuation",
+			snippet: "RUN echo a \\\n",
+			wantErr: true,
+		},
+		{
+			name:    "FROM",
+			snippet: "FROM ubuntu\n",
+			wantErr: true,
+		},
+		{
+			name:    "unsupported instruction",
+			snippet: "CMD sh\n",
+			wantErr: true,
+		},
+		{
+			name:    "COPY flags",
+			snippet: "COPY --chown=1 a /a\n",
+			wantErr: true,
+		},
+		{
+			name:    "COPY without destination",
+			snippet: "COPY a\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			steps, err := parseDockerfileSnippet(strings.NewReader(tt.snippet))
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			var got []string
+			for _, s := range steps {
+				got = append(got, s.String())
+			}
+			if !reflect.DeepEqual(got, tt.wantSteps) {
+				t.Errorf("got steps %q, want %q", got, tt.wantSteps)
+			}
+		})
+	}
+}
+
+func TestEnvVars(t *testing.T) {
+	tests := []struct {
+		args    string
+		want    []string
+		wantErr bool
+	}{
+		{args: "A=1", want: []string{"A=1"}},
+		{args: "A=1 B=2", want: []string{"A=1", "B=2"}},
+		{args: `A="a b" B=c`, want: []string{"A=a b", "B=c"}},
+		{args: `A='a "b"'`, want: []string{`A=a "b"`}},
+		{args: `A=a\ b`, want: []string{"A=a b"}},
+		{args: `A="a \"b\""`, want: []string{`A=a "b"`}},
+		{args: `A="a\b"`, want: []string{`A=a\b`}},
+		{args: `A= B=1`, want: []string{"A=", "B=1"}},
+		{args: "A a b", want: []string{"A=a b"}},
+		{args: "A\ta b", want: []string{"A=a b"}},
+		{args: "A  a  b", want: []string{"A=a  b"}},
+		{args: "A \t a", want: []string{"A=a"}},
+		{args: `A "a b"`, want: []string{"A=a b"}},
+		{args: "A", wantErr: true},
+		{args: `A="a b`, wantErr: true},
+		{args: "A=1 B", wantErr: true},
+		{args: "=1", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.args, func(t *testing.T) {
+			got, err := dockerfileStep{Instruction: "ENV", Args: tt.args}.envVars()
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCopyStepFiles(t *testing.T) {
+	contextDir, err := ioutil.TempDir("", "dockerfile-context")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(contextDir)
+	for _, name := range []string{"a.conf", "b.conf", "dir/c"} {
+		file := filepath.Join(contextDir, name)
+		if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(file, nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx := func(name string) string { return filepath.Join(contextDir, name) }
+
+	tests := []struct {
+		name      string
+		args      string
+		destIsDir bool
+		want      []fileSpec
+		wantErr   bool
+	}{
+		{
+			name: "file to file",
+			args: "a.conf /etc/app.conf",
+			want: []fileSpec{{Src: ctx("a.conf"), Dest: "/etc/app.conf"}},
+		},
+		{
+			name: "file to directory with slash",
+			args: "a.conf /etc/",
+			want: []fileSpec{{Src: ctx("a.conf"), Dest: "/etc/a.conf"}},
+		},
+		{
+			name:      "file to existing directory",
+			args:      "a.conf /etc",
+			destIsDir: true,
+			want:      []fileSpec{{Src: ctx("a.conf"), Dest: "/etc/a.conf"}},
+		},
+		{
+			name: "relative destination",
+			args: "a.conf etc/app.conf",
+			want: []fileSpec{{Src: ctx("a.conf"), Dest: "/etc/app.conf"}},
+		},
+		{
+			name: "glob",
+			args: "*.conf /etc",
+			want: []fileSpec{
+				{Src: ctx("a.conf"), Dest: "/etc/a.conf"},
+				{Src: ctx("b.conf"), Dest: "/etc/b.conf"},
+			},
+		},
+		{
+			name: "directory contents",
+			args: "dir /opt/dir",
+			want: []fileSpec{{Src: ctx("dir"), Dest: "/opt/dir"}},
+		},
+		{
+			name: "source outside the context",
+			args: "../a.conf /etc/",
+			want: []fileSpec{{Src: ctx("a.conf"), Dest: "/etc/a.conf"}},
+		},
+		{
+			name:    "missing source",
+			args:    "missing /etc/",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			step := dockerfileStep{Instruction: "COPY", Args: tt.args}
+			got, err := copyStepFiles(step, contextDir, tt.destIsDir)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,36 @@
+package cmd
+
+import (
+	"fmt"
+)
+
+// updateFromImages removes the images to be removed from the from VM image in
+// the build container and returns the images of the spec missing in it, to be
+// pulled.
+func updateFromImages(sb buildSandbox, rt containerRuntime, spec *vmImageSpec) ([]imageSpec, error) {
+	present, err := listImages(sb, rt, spec.Namespace)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, img := range spec.Remove {
+		rtImg, ok := findImage(present, img)
+		if !ok {
+			return nil, fmt.Errorf("image %q to be removed not found in VM image %q", img, spec.From)
+		}
+		fmt.Printf("Removing image %s...\n", img)
+		if _, err := runExec(sb, rt.RemoveImageCmd(spec.Namespace, rtImg.Ref)); err != nil {
+			return nil, fmt.Errorf("failed to remove image %q: %v", img, err)
+		}
+	}
+
+	var missing []imageSpec
+	for _, img := range spec.Images {
+		if _, ok := findImage(present, img.Name); ok {
+			fmt.Printf("Image %s already present, skipping pull\n", img.Name)
+			continue
+		}
+		missing = append(missing, img)
+	}
+	return missing, nil
+}
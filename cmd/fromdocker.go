@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+	"io"
+
+	reference "github.com/containerd/containerd/reference/docker"
+	docker "github.com/fsouza/go-dockerclient"
+)
+
+// importDockerImage exports an image from the host docker daemon and streams
+// it into the container runtime of the build container, importing it into the
+// given namespace. It returns the normalized reference of the imported image.
+func importDockerImage(client *docker.Client, sb buildSandbox, rt containerRuntime, namespace, image string) (string, error) {
+	// The images are listed with normalized references.
+	ref, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %v", image, err)
+	}
+
+	// Ensure the image exists before starting the import to avoid importing
+	// an empty stream.
+	if _, err := client.InspectImage(image); err != nil {
+		return "", fmt.Errorf("failed to find image %q in the host docker: %v", image, err)
+	}
+
+	pr, pw := io.Pipe()
+	go func() {
+		exportOpts := docker.ExportImageOptions{
+			Name:         image,
+			OutputStream: pw,
+		}
+		pw.CloseWithError(client.ExportImage(exportOpts))
+	}()
+
+	// Read the image archive from the exec stdin.
+	fmt.Printf("Waiting for %s image import from the host docker to complete", image)
+	importOpts := execOptions{
+		Cmd:   rt.ImportCmd(namespace, "-", ""),
+		Stdin: pr,
+	}
+	err = withProgressDots(func() error {
+		_, err := execInSandbox(sb, importOpts)
+		return err
+	})
+	// Newline.
+	fmt.Println()
+	// Unblock the export if the import failed before reading everything.
+	pr.CloseWithError(err)
+	if err != nil {
+		return "", fmt.Errorf("failed to import image %q from the host docker: %v", image, err)
+	}
+
+	return ref.String(), nil
+}
@@ -26,4 +26,8 @@ func init() {
 	// Cobra supports local flags which will only run when this command
 	// is called directly, e.g.:
 	// imageCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
+
+	imageCmd.PersistentFlags().StringVar(&builderName, "builder", builderDocker, "Image build backend, docker or containerd (the host containerd, without docker)")
+	imageCmd.PersistentFlags().StringVar(&containerdAddress, "containerd-address", defaultContainerdAddress, "Address of the host containerd socket used by the containerd builder")
+	imageCmd.PersistentFlags().StringVar(&containerdBuildNamespace, "containerd-namespace", defaultContainerdBuildNamespace, "Host containerd namespace of the images and build containers of the containerd builder")
 }
@@ -0,0 +1,55 @@
+package cmd
+
+import (
+	"fmt"
+
+	igniteRun "github.com/weaveworks/ignite/cmd/ignite/run"
+	api "github.com/weaveworks/ignite/pkg/apis/ignite"
+	meta "github.com/weaveworks/ignite/pkg/apis/meta/v1alpha1"
+	"github.com/weaveworks/ignite/pkg/providers"
+	"github.com/weaveworks/ignite/pkg/runtime"
+	"github.com/weaveworks/libgitops/pkg/filter"
+	"github.com/weaveworks/libgitops/pkg/storage/filterer"
+)
+
+// importVMImage imports a VM image from the given builder into the ignite image
+// store, using the ignite runtime of the builder. imageID is the image ID of the
+// VM image in the builder. An ignite image of the same name imported from a
+// different image is replaced.
+func importVMImage(image, imageID, builder string) (*api.Image, error) {
+	rtName := runtime.RuntimeDocker
+	if builder == builderContainerd {
+		rtName = runtime.RuntimeContainerd
+	}
+	if err := initIgniteProviders(rtName); err != nil {
+		return nil, err
+	}
+
+	// ignite names the images with the OCI image reference.
+	ociRef, err := meta.NewOCIImageRef(image)
+	if err != nil {
+		return nil, err
+	}
+
+	// ignite reuses an image of the same name, remove it if it's stale.
+	existing, err := providers.Client.Images().Find(filter.NewIDNameFilter(ociRef.String()))
+	switch err.(type) {
+	case nil:
+		if id := existing.Status.OCISource.ID; id != nil && id.Digest().String() == imageID {
+			return existing, nil
+		}
+		fmt.Printf("Removing outdated ignite image %s (%s)...\n", image, existing.GetUID())
+		rmiOpts, err := (&igniteRun.RmiFlags{}).NewRmiOptions([]string{existing.GetUID().String()})
+		if err != nil {
+			return nil, err
+		}
+		if err := igniteRun.Rmi(rmiOpts); err != nil {
+			return nil, fmt.Errorf("failed to remove outdated ignite image %q: %v", image, err)
+		}
+	case *filterer.NonexistentError:
+	default:
+		return nil, fmt.Errorf("failed to find ignite image %q: %v", image, err)
+	}
+
+	return igniteRun.ImportImage(image)
+}
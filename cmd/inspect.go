@@ -0,0 +1,102 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"text/tabwriter"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// inspectOutput is the output format of the inspect command.
+	inspectOutput string
+)
+
+// inspectCmd represents the inspect command
+var inspectCmd = &cobra.Command{
+	Use:   "inspect <vm-image-name>",
+	Short: "Show the contents of a VM image.",
+	Long: `Show the base image, container runtime and preloaded images of a VM image
+built by ignite-cntr, as recorded in the VM image labels.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("require one VM image name argument")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runInspect(args[0], inspectOutput); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+func runInspect(image, output string) error {
+	if output != outputTable && output != outputJSON {
+		return fmt.Errorf("invalid output format %q, want %s or %s", output, outputTable, outputJSON)
+	}
+
+	b, err := newImageBuilder(builderName)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	manifest, err := getVMImageManifest(b, image)
+	if err != nil {
+		return err
+	}
+
+	if output == outputJSON {
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetIndent("", "  ")
+		return enc.Encode(manifest)
+	}
+	printManifest(manifest)
+	return nil
+}
+
+// getVMImageManifest returns the manifest of a local VM image of the builder.
+func getVMImageManifest(b imageBuilder, image string) (*vmImageManifest, error) {
+	img, err := b.InspectImage(image)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest, err := manifestFromLabels(img.Labels)
+	if err != nil {
+		return nil, fmt.Errorf("invalid manifest of image %q: %v", image, err)
+	}
+	if manifest == nil {
+		return nil, fmt.Errorf("image %q has no ignite-cntr manifest, not a VM image built by ignite-cntr", image)
+	}
+	return manifest, nil
+}
+
+// printManifest prints a VM image manifest as tables.
+func printManifest(m *vmImageManifest) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintf(w, "Base image:\t%s\n", m.BaseImage)
+	fmt.Fprintf(w, "Base image ID:\t%s\n", m.BaseImageID)
+	fmt.Fprintf(w, "Platform:\t%s\n", m.Platform)
+	fmt.Fprintf(w, "Runtime:\t%s\n", m.Runtime)
+	fmt.Fprintf(w, "Namespace:\t%s\n", m.Namespace)
+	w.Flush()
+
+	fmt.Println()
+	w = tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tDIGEST\tSIZE")
+	for _, img := range m.Images {
+		fmt.Fprintf(w, "%s\t%s\t%s\n", img.Ref, img.Digest, img.Size)
+	}
+	w.Flush()
+}
+
+func init() {
+	imageCmd.AddCommand(inspectCmd)
+
+	inspectCmd.Flags().StringVarP(&inspectOutput, "output", "o", outputTable, "Output format, table or json")
+}
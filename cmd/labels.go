@@ -0,0 +1,30 @@
+package cmd
+
+// Labels added by ignite-cntr to the images it builds.
+const (
+	// platformLabel is the platform of the image, in <os>/<arch>[/<variant>]
+	// format.
+	platformLabel = "ignite-cntr.platform"
+	// runtimeLabel is the name of the container runtime installed in the
+	// image.
+	runtimeLabel = "ignite-cntr.runtime"
+	// baseImageLabel is the base image a VM image is built from.
+	baseImageLabel = "ignite-cntr.base-image"
+	// baseImageIDLabel is the ID of the base image a VM image is built from.
+	baseImageIDLabel = "ignite-cntr.base-image-id"
+	// namespaceLabel is the runtime namespace of the preloaded images of a VM
+	// image.
+	namespaceLabel = "ignite-cntr.namespace"
+	// imagesLabel is the JSON list of the preloaded images of a VM image.
+	imagesLabel = "ignite-cntr.images"
+)
+
+// Labels added by ignite-cntr to the app containers it runs.
+const (
+	// networkLabel is the CNI network of an app container, unset with host
+	// networking.
+	networkLabel = "ignite-cntr.network"
+	// portsLabel is the JSON list of the published ports of an app container
+	// in the network, to remove their mappings with the container.
+	portsLabel = "ignite-cntr.ports"
+)
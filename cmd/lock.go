@@ -0,0 +1,151 @@
+package cmd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+
+	reference "github.com/containerd/containerd/reference/docker"
+	digest "github.com/opencontainers/go-digest"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// defaultLockFile is the default path of the lock file.
+	defaultLockFile = "ignite-cntr.lock"
+
+	// lockFileVersion is the version of the lock file format.
+	lockFileVersion = "v1alpha1"
+)
+
+// lockFile records the digests the images of a VM image build resolved to, to
+// pull the same content in later builds.
+type lockFile struct {
+	// Version is the version of the lock file format.
+	Version string `json:"version"`
+	// Images are the locked images.
+	Images []lockedImage `json:"images"`
+}
+
+// lockedImage is an image reference along with the digest it resolved to.
+type lockedImage struct {
+	// Name is the image reference as passed to the build.
+	Name string `json:"name"`
+	// Digest is the digest of the image in the registry.
+	Digest string `json:"digest"`
+}
+
+// newLockFile creates a lock file of the given images with the digests of the
+// images in the runtime.
+func newLockFile(images []imageSpec, rtImages map[string]runtimeImage) (*lockFile, error) {
+	lock := &lockFile{Version: lockFileVersion}
+	for _, img := range images {
+		rtImg, _ := findImage(rtImages, img.Name)
+		if rtImg.Digest == "" {
+			return nil, fmt.Errorf("failed to find the digest of image %q", img.Name)
+		}
+		lock.Images = append(lock.Images, lockedImage{Name: img.Name, Digest: rtImg.Digest})
+	}
+	return lock, nil
+}
+
+// readLockFile reads the lock file at path.
+func readLockFile(path string) (*lockFile, error) {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("lock file %q not found, build without --locked to create it", path)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read lock file: %v", err)
+	}
+
+	lock := &lockFile{}
+	if err := yaml.UnmarshalStrict(data, lock); err != nil {
+		return nil, fmt.Errorf("failed to parse lock file %q: %v", path, err)
+	}
+	if lock.Version != lockFileVersion {
+		return nil, fmt.Errorf("unsupported lock file version %q, want %q", lock.Version, lockFileVersion)
+	}
+	for i, img := range lock.Images {
+		if img.Name == "" || img.Digest == "" {
+			return nil, fmt.Errorf("invalid lock file %q: images[%d]: name and digest must be set", path, i)
+		}
+	}
+	return lock, nil
+}
+
+// write writes the lock file to path.
+func (l *lockFile) write(path string) error {
+	data, err := yaml.Marshal(l)
+	if err != nil {
+		return err
+	}
+	header := []byte("# Generated by ignite-cntr, do not edit.\n")
+	if err := ioutil.WriteFile(path, append(header, data...), 0644); err != nil {
+		return fmt.Errorf("failed to write lock file: %v", err)
+	}
+	return nil
+}
+
+// digests returns the locked digests of the given images, keyed by image
+// reference. All the images must be locked.
+func (l *lockFile) digests(images []imageSpec) (map[string]string, error) {
+	locked := map[string]string{}
+	for _, img := range l.Images {
+		locked[img.Name] = img.Digest
+	}
+
+	digests := map[string]string{}
+	var missing []string
+	for _, img := range images {
+		imgDigest, ok := locked[img.Name]
+		if !ok {
+			missing = append(missing, img.Name)
+			continue
+		}
+		digests[img.Name] = imgDigest
+	}
+	if len(missing) > 0 {
+		return nil, fmt.Errorf("images not found in the lock file, build without --locked to update it: %v", missing)
+	}
+	return digests, nil
+}
+
+// verifyLockedDigests checks that the images in the runtime have the locked
+// digests.
+func verifyLockedDigests(digests map[string]string, rtImages map[string]runtimeImage) error {
+	var mismatch []string
+	for name, imgDigest := range digests {
+		if rtImg, _ := findImage(rtImages, name); rtImg.Digest != imgDigest {
+			mismatch = append(mismatch, fmt.Sprintf("%s: got %s, want %s", name, rtImg.Digest, imgDigest))
+		}
+	}
+	if len(mismatch) > 0 {
+		sort.Strings(mismatch)
+		return fmt.Errorf("images don't match the lock file: %v", mismatch)
+	}
+	return nil
+}
+
+// pinnedRef returns the reference of an image pinned to the given digest,
+// <name>@<digest> without the tag. References with a digest are already
+// pinned and are returned as is.
+func pinnedRef(image, imageDigest string) (string, error) {
+	named, err := reference.ParseDockerRef(image)
+	if err != nil {
+		return "", fmt.Errorf("invalid image reference %q: %v", image, err)
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return image, nil
+	}
+	dgst, err := digest.Parse(imageDigest)
+	if err != nil {
+		return "", fmt.Errorf("invalid digest %q of image %q: %v", imageDigest, image, err)
+	}
+	pinned, err := reference.WithDigest(reference.TrimNamed(named), dgst)
+	if err != nil {
+		return "", err
+	}
+	return pinned.String(), nil
+}
@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// vmImageManifest describes the contents of a VM image. It's recorded in the
+// labels of the VM image.
+type vmImageManifest struct {
+	// BaseImage is the base image the VM image is built from.
+	BaseImage string `json:"baseImage"`
+	// BaseImageID is the ID of the base image.
+	BaseImageID string `json:"baseImageID"`
+	// Platform is the platform of the VM image.
+	Platform string `json:"platform"`
+	// Runtime is the container runtime installed in the VM image.
+	Runtime string `json:"runtime"`
+	// Namespace is the runtime namespace of the preloaded images.
+	Namespace string `json:"namespace"`
+	// Images are the preloaded images.
+	Images []manifestImage `json:"images"`
+}
+
+// manifestImage is a preloaded image of a VM image.
+type manifestImage struct {
+	// Ref is the image reference.
+	Ref string `json:"ref"`
+	// Digest is the registry digest of the image. Empty for the images
+	// loaded into docker.
+	Digest string `json:"digest"`
+	// Size is the human readable size of the image as reported by the
+	// runtime.
+	Size string `json:"size"`
+}
+
+// newManifestImages returns the manifest images of the listed runtime images,
+// sorted by reference.
+func newManifestImages(rtImages map[string]runtimeImage) []manifestImage {
+	images := []manifestImage{}
+	for ref, img := range rtImages {
+		images = append(images, manifestImage{
+			Ref:    ref,
+			Digest: img.Digest,
+			Size:   img.Size,
+		})
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].Ref < images[j].Ref
+	})
+	return images
+}
+
+// labels returns the image labels recording the manifest.
+func (m *vmImageManifest) labels() (map[string]string, error) {
+	images, err := json.Marshal(m.Images)
+	if err != nil {
+		return nil, err
+	}
+	return map[string]string{
+		baseImageLabel:   m.BaseImage,
+		baseImageIDLabel: m.BaseImageID,
+		platformLabel:    m.Platform,
+		runtimeLabel:     m.Runtime,
+		namespaceLabel:   m.Namespace,
+		imagesLabel:      string(images),
+	}, nil
+}
+
+// manifestFromLabels reads the manifest of a VM image from the image labels.
+// nil is returned if the image has no manifest, i.e. it isn't a VM image built
+// by ignite-cntr.
+func manifestFromLabels(labels map[string]string) (*vmImageManifest, error) {
+	imagesJSON, ok := labels[imagesLabel]
+	if !ok {
+		return nil, nil
+	}
+
+	m := &vmImageManifest{
+		BaseImage:   labels[baseImageLabel],
+		BaseImageID: labels[baseImageIDLabel],
+		Platform:    labels[platformLabel],
+		Runtime:     labels[runtimeLabel],
+		Namespace:   labels[namespaceLabel],
+	}
+	if err := json.Unmarshal([]byte(imagesJSON), &m.Images); err != nil {
+		return nil, fmt.Errorf("invalid %s label: %v", imagesLabel, err)
+	}
+	return m, nil
+}
@@ -0,0 +1,73 @@
+package cmd
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var (
+	// optimizeVM enables shrinking the VM image: the runtime garbage
+	// collection, the removal of caches, temporary files and logs, and the
+	// layer squashing.
+	optimizeVM bool
+	// dropBlobs enables removing the compressed layer blobs of the unpacked
+	// images in an optimized build.
+	dropBlobs bool
+)
+
+// cleanupScript removes the files of the build container that aren't needed in
+// the VM image. The logs are truncated, the services may expect the files.
+const cleanupScript = `set -e
+rm -rf /tmp/* /tmp/.[!.]* /var/tmp/* /var/cache/apt/archives/*.deb /var/lib/apt/lists/*
+find /var/log -type f -exec truncate -s 0 {} +`
+
+// optimizeSandbox removes the unused runtime data and the leftover files of the
+// build sandbox before committing it, and prints the filesystem size before
+// and after.
+func optimizeSandbox(sb buildSandbox, rt containerRuntime, namespace string, dropBlobs bool) error {
+	fmt.Println("Optimizing the build container...")
+	before, err := sandboxDiskUsage(sb)
+	if err != nil {
+		return err
+	}
+
+	for _, cmd := range rt.GCCmds(namespace, dropBlobs) {
+		if _, err := runExec(sb, cmd); err != nil {
+			return fmt.Errorf("failed to run the %s garbage collection: %v", rt.Name(), err)
+		}
+	}
+	if _, err := runExec(sb, []string{"sh", "-c", cleanupScript}); err != nil {
+		return fmt.Errorf("failed to clean up the build container: %v", err)
+	}
+
+	after, err := sandboxDiskUsage(sb)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Build container filesystem size: %s -> %s\n", formatKiB(before), formatKiB(after))
+	return nil
+}
+
+// sandboxDiskUsage returns the disk usage of the root filesystem of the build
+// sandbox in KiB.
+func sandboxDiskUsage(sb buildSandbox) (int64, error) {
+	output, err := runExec(sb, []string{"du", "-sxk", "/"})
+	if err != nil {
+		return 0, fmt.Errorf("failed to get the disk usage of the build container: %v", err)
+	}
+	fields := strings.Fields(string(output))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("failed to parse the disk usage of the build container: %q", output)
+	}
+	kib, err := strconv.ParseInt(fields[0], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse the disk usage of the build container: %v", err)
+	}
+	return kib, nil
+}
+
+// formatKiB formats a size in KiB in MiB.
+func formatKiB(kib int64) string {
+	return fmt.Sprintf("%.1fMiB", float64(kib)/1024)
+}
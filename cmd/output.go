@@ -0,0 +1,138 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Output formats of the commands.
+const (
+	outputText  = "text"
+	outputTable = "table"
+	outputJSON  = "json"
+)
+
+// buildOutput prints the progress of an image build and streams the build
+// logs. In JSON output, the progress messages are printed as docker JSON
+// stream messages, like the build logs.
+type buildOutput struct {
+	// json enables the JSON output.
+	json bool
+	// log is the destination of the build logs.
+	log io.Writer
+	// logFile is the log file, nil when the logs are streamed to stdout.
+	logFile *os.File
+}
+
+// newBuildOutput creates a build output in the given format. The build logs
+// are written to logPath if set, else to stdout.
+func newBuildOutput(format, logPath string) (*buildOutput, error) {
+	if format != outputText && format != outputJSON {
+		return nil, fmt.Errorf("invalid output format %q, want %s or %s", format, outputText, outputJSON)
+	}
+
+	out := &buildOutput{
+		json: format == outputJSON,
+		log:  os.Stdout,
+	}
+	if logPath != "" {
+		f, err := os.Create(logPath)
+		if err != nil {
+			return nil, fmt.Errorf("failed to create log file: %v", err)
+		}
+		out.log = f
+		out.logFile = f
+	}
+	return out, nil
+}
+
+// printf prints a progress message.
+func (o *buildOutput) printf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if !o.json {
+		fmt.Print(msg)
+		return
+	}
+	json.NewEncoder(os.Stdout).Encode(struct {
+		Stream string `json:"stream"`
+	}{msg})
+}
+
+// errorf prints a build error.
+func (o *buildOutput) errorf(format string, a ...interface{}) {
+	msg := fmt.Sprintf(format, a...)
+	if !o.json {
+		fmt.Printf("error: %s\n", msg)
+		return
+	}
+	json.NewEncoder(os.Stdout).Encode(struct {
+		Error string `json:"error"`
+	}{msg})
+}
+
+// close closes the log file.
+func (o *buildOutput) close() error {
+	if o.logFile == nil {
+		return nil
+	}
+	return o.logFile.Close()
+}
+
+// jsonStreamWriter passes a docker JSON message stream through to w, recording
+// the first error message of the stream. The docker client doesn't report the
+// stream errors when the raw JSON stream is requested.
+type jsonStreamWriter struct {
+	w io.Writer
+	// partial is the incomplete last line of the stream.
+	partial []byte
+	// err is the first error message of the stream.
+	err string
+}
+
+// Write writes b to the underlying writer and parses the complete messages.
+func (j *jsonStreamWriter) Write(b []byte) (int, error) {
+	j.partial = append(j.partial, b...)
+	for {
+		i := bytes.IndexByte(j.partial, '\n')
+		if i < 0 {
+			break
+		}
+		msg := struct {
+			Error string `json:"error"`
+		}{}
+		if json.Unmarshal(j.partial[:i], &msg) == nil && msg.Error != "" && j.err == "" {
+			j.err = msg.Error
+		}
+		j.partial = j.partial[i+1:]
+	}
+	return j.w.Write(b)
+}
+
+// error returns the first error message of the stream, nil if there's none.
+func (j *jsonStreamWriter) error() error {
+	if j.err == "" {
+		return nil
+	}
+	return errors.New(j.err)
+}
+
+// jsonStreamEncoder writes the data written to it to w as docker JSON stream
+// messages, for the build logs not coming from docker.
+type jsonStreamEncoder struct {
+	w io.Writer
+}
+
+// Write writes b to the underlying writer as a stream message.
+func (j *jsonStreamEncoder) Write(b []byte) (int, error) {
+	err := json.NewEncoder(j.w).Encode(struct {
+		Stream string `json:"stream"`
+	}{string(b)})
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/containerd/containerd/platforms"
+	specs "github.com/opencontainers/image-spec/specs-go/v1"
+	api "github.com/weaveworks/ignite/pkg/apis/ignite"
+)
+
+// normalizePlatform parses a platform specifier and returns it in the
+// normalized <os>/<arch>[/<variant>] format.
+func normalizePlatform(platform string) (string, error) {
+	p, err := platforms.Parse(platform)
+	if err != nil {
+		return "", fmt.Errorf("invalid platform %q: %v", platform, err)
+	}
+	return platforms.Format(p), nil
+}
+
+// samePlatform returns true if the OS and architecture of the platforms are
+// the same.
+func samePlatform(a, b specs.Platform) bool {
+	a, b = platforms.Normalize(a), platforms.Normalize(b)
+	return a.OS == b.OS && a.Architecture == b.Architecture
+}
+
+// ensureBaseImage ensures that the base image is available locally in the
+// builder, pulling it for the given platform if needed, and returns the base
+// image and its platform. When platform is set, the local base image must be of
+// the platform.
+func ensureBaseImage(b imageBuilder, image, platform string) (*builderImage, string, error) {
+	img, err := b.EnsureImage(image, platform)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to get base image: %v", err)
+	}
+
+	imgPlatform := img.Platform
+	if platform != "" {
+		want, err := platforms.Parse(platform)
+		if err != nil {
+			return nil, "", fmt.Errorf("invalid platform %q: %v", platform, err)
+		}
+		if !samePlatform(want, imgPlatform) {
+			return nil, "", fmt.Errorf("base image %q is for platform %s, want %s; build or pull the base image for %s", image, platforms.Format(imgPlatform), platform, platform)
+		}
+		return img, platforms.Format(want), nil
+	}
+
+	return img, platforms.Format(platforms.Normalize(imgPlatform)), nil
+}
+
+// checkVMPlatform checks that the VM image of a VM, if built by ignite-cntr,
+// is for the host platform. labels are the labels of the VM image.
+func checkVMPlatform(vm *api.VM, labels map[string]string) error {
+	if labels[platformLabel] == "" {
+		return nil
+	}
+
+	image := vm.Spec.Image.OCI.String()
+	imgPlatform, err := platforms.Parse(labels[platformLabel])
+	if err != nil {
+		return fmt.Errorf("invalid platform label of VM image %q: %v", image, err)
+	}
+	if !samePlatform(imgPlatform, platforms.DefaultSpec()) {
+		return fmt.Errorf("VM %q image %q is for platform %s, the host platform is %s", vm.Name, image, platforms.Format(imgPlatform), platforms.DefaultString())
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+const (
+	// defaultPruneOlderThan is the default minimum age of the pruned build
+	// containers, longer than a build.
+	defaultPruneOlderThan = time.Hour
+)
+
+var (
+	// pruneOlderThan is the minimum age of the build containers to be pruned.
+	pruneOlderThan time.Duration
+)
+
+// pruneCmd represents the prune command
+var pruneCmd = &cobra.Command{
+	Use:   "prune",
+	Short: "Remove stale build containers.",
+	Long: `Remove the build containers left behind by interrupted or failed VM image
+builds, and the ones kept with --keep-build-container. Only the build containers
+older than --older-than are removed, the younger ones may belong to running
+builds.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return errors.New("require no arguments")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runPrune(pruneOlderThan); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+func runPrune(olderThan time.Duration) error {
+	b, err := newImageBuilder(builderName)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	sandboxes, err := b.ListSandboxes()
+	if err != nil {
+		return err
+	}
+
+	removed := 0
+	for _, sandbox := range sandboxes {
+		if time.Since(sandbox.Created) < olderThan {
+			continue
+		}
+
+		if err := b.RemoveSandbox(sandbox.Name); err != nil {
+			return fmt.Errorf("failed to remove build container %s: %v", sandbox.Name, err)
+		}
+		fmt.Printf("Removed build container %s\n", sandbox.Name)
+		removed++
+	}
+
+	fmt.Printf("Removed %d build container(s)\n", removed)
+	return nil
+}
+
+func init() {
+	imageCmd.AddCommand(pruneCmd)
+
+	pruneCmd.Flags().DurationVar(&pruneOlderThan, "older-than", defaultPruneOlderThan, "Only remove the build containers older than the given duration, to spare running builds; 0 removes all")
+}
@@ -0,0 +1,287 @@
+package cmd
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	// defaultPullParallelism is the default number of images pulled
+	// concurrently.
+	defaultPullParallelism = 3
+
+	// pullProgressInterval is the interval at which the pull progress is
+	// printed.
+	pullProgressInterval = 3 * time.Second
+)
+
+var (
+	// ansiEscapeRegexp matches the terminal control sequences in the ctr
+	// progress output.
+	ansiEscapeRegexp = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+	// pullLayerRegexp matches a layer status line of the ctr pull progress,
+	// capturing the layer digest and status.
+	pullLayerRegexp = regexp.MustCompile(`^layer-(sha256:[0-9a-f]+):\s+(\w+)`)
+	// pullTotalRegexp matches the total downloaded size in the ctr pull
+	// progress.
+	pullTotalRegexp = regexp.MustCompile(`total:\s+([0-9.]+ \S+)`)
+	// dockerPullLayerRegexp matches a layer status line of the docker pull
+	// output, capturing the layer ID and status.
+	dockerPullLayerRegexp = regexp.MustCompile(`^([0-9a-f]{12}): ([A-Za-z ]+)$`)
+)
+
+// pullResult is the result of an image pull.
+type pullResult struct {
+	// Image is the pulled image reference.
+	Image string
+	// Duration is the time taken to pull the image.
+	Duration time.Duration
+	// Progress is the final progress of the pull.
+	Progress *pullProgress
+}
+
+// pullImages pulls the given images of the spec in the build sandbox,
+// pulling at most parallel images concurrently. The progress of the pulls is
+// printed periodically.
+// digests are the locked digests of the images to be pulled by digest, nil to
+// pull by reference.
+func pullImages(sb buildSandbox, rt containerRuntime, spec *vmImageSpec, images []imageSpec, digests map[string]string, authStore *registryAuthStore, parallel int) ([]*pullResult, error) {
+	if parallel < 1 {
+		return nil, fmt.Errorf("invalid pull parallelism %d, must be at least 1", parallel)
+	}
+
+	results := make([]*pullResult, len(images))
+	for i, img := range images {
+		results[i] = &pullResult{Image: img.Name, Progress: &pullProgress{}}
+	}
+
+	stopProgress := make(chan struct{})
+	progressDone := make(chan struct{})
+	go func() {
+		printPullProgress(results, stopProgress)
+		close(progressDone)
+	}()
+
+	var g errgroup.Group
+	// Limit the number of concurrent pulls.
+	sem := make(chan struct{}, parallel)
+	for i := range images {
+		img := images[i]
+		result := results[i]
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() { <-sem }()
+			pullOpts := pullOptions{
+				Namespace: spec.Namespace,
+				Platform:  spec.Platform,
+				Image:     img,
+				Digest:    digests[img.Name],
+			}
+			return pullImage(sb, rt, pullOpts, authStore, result)
+		})
+	}
+	err := g.Wait()
+
+	close(stopProgress)
+	<-progressDone
+
+	return results, err
+}
+
+// pullImage pulls an image in the build container, recording the pull
+// progress and duration in result. Images with a digest in opts are pulled by
+// digest and named with their reference.
+func pullImage(sb buildSandbox, rt containerRuntime, opts pullOptions, authStore *registryAuthStore, result *pullResult) error {
+	img := opts.Image
+	registry, auth, err := authStore.authFor(img.Name)
+	if err != nil {
+		return fmt.Errorf("failed to get registry credentials for image %q: %v", img.Name, err)
+	}
+	var env []string
+	if auth != nil {
+		env = append(env, auth.env())
+		opts.Registry = registry
+		opts.Auth = true
+	}
+
+	// Pull by digest to get the locked content.
+	if opts.Digest != "" {
+		pinned, err := pinnedRef(img.Name, opts.Digest)
+		if err != nil {
+			return err
+		}
+		opts.Image.Name = pinned
+	}
+
+	fmt.Printf("Pulling image %s...\n", img.Name)
+	result.Progress.start()
+	pullOpts := execOptions{
+		Cmd:    rt.PullCmd(opts),
+		Env:    env,
+		Output: result.Progress,
+	}
+	_, err = execInSandbox(sb, pullOpts)
+	if err == nil && opts.Image.Name != img.Name {
+		for _, pinCmd := range rt.PinImageCmds(opts.Namespace, opts.Image.Name, img.Name) {
+			if _, err = runExec(sb, pinCmd); err != nil {
+				break
+			}
+		}
+	}
+	result.Duration = result.Progress.finish()
+	if err != nil {
+		return fmt.Errorf("failed to pull image %q: %v", img.Name, err)
+	}
+
+	fmt.Printf("Pulled image %s in %s\n", img.Name, result.Duration.Round(100*time.Millisecond))
+	return nil
+}
+
+// printPullProgress prints the progress of the running pulls periodically
+// until stop is closed.
+func printPullProgress(results []*pullResult, stop <-chan struct{}) {
+	ticker := time.NewTicker(pullProgressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			for _, result := range results {
+				if result.Progress.running() {
+					fmt.Printf("  %s: %s\n", result.Image, result.Progress)
+				}
+			}
+		}
+	}
+}
+
+// printPullSummary prints the duration and size of the pulled images. sizes
+// are the sizes of the images keyed by normalized image reference.
+func printPullSummary(results []*pullResult, sizes map[string]string) {
+	if len(results) == 0 {
+		return
+	}
+
+	fmt.Println("\nPulled images:")
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "IMAGE\tDURATION\tSIZE")
+	for _, result := range results {
+		size := sizes[normalizeImageRef(result.Image)]
+		if size == "" {
+			size = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", result.Image, result.Duration.Round(100*time.Millisecond), size)
+	}
+	w.Flush()
+}
+
+// pullProgress tracks the progress of an image pull by parsing the ctr or
+// docker pull output written to it.
+type pullProgress struct {
+	mu sync.Mutex
+	// partial is the incomplete last line of the output.
+	partial []byte
+	// layers is the completion state of the image layers, keyed by digest.
+	layers map[string]bool
+	// total is the total downloaded size.
+	total string
+	// startTime is the time when the pull started. Zero before start.
+	startTime time.Time
+	// finished is true once the pull is complete.
+	finished bool
+}
+
+// start marks the start of the pull.
+func (p *pullProgress) start() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startTime = time.Now()
+}
+
+// finish marks the end of the pull and returns the pull duration.
+func (p *pullProgress) finish() time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.finished = true
+	return time.Since(p.startTime)
+}
+
+// running returns true if the pull has started and is not complete.
+func (p *pullProgress) running() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return !p.startTime.IsZero() && !p.finished
+}
+
+// Write parses the complete lines of the pull output.
+func (p *pullProgress) Write(b []byte) (int, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.partial = append(p.partial, b...)
+	for {
+		i := bytes.IndexAny(p.partial, "\r\n")
+		if i < 0 {
+			break
+		}
+		p.parseLine(string(p.partial[:i]))
+		p.partial = p.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// parseLine updates the progress from a line of the pull output.
+func (p *pullProgress) parseLine(line string) {
+	line = strings.TrimSpace(ansiEscapeRegexp.ReplaceAllString(line, ""))
+
+	if m := pullLayerRegexp.FindStringSubmatch(line); m != nil {
+		if p.layers == nil {
+			p.layers = map[string]bool{}
+		}
+		status := m[2]
+		p.layers[m[1]] = status == "done" || status == "exists"
+		return
+	}
+	if m := dockerPullLayerRegexp.FindStringSubmatch(line); m != nil {
+		if p.layers == nil {
+			p.layers = map[string]bool{}
+		}
+		status := m[2]
+		p.layers[m[1]] = status == "Pull complete" || status == "Already exists"
+		return
+	}
+	if m := pullTotalRegexp.FindStringSubmatch(line); m != nil {
+		p.total = m[1]
+	}
+}
+
+// String returns the layers and size progress of the pull.
+func (p *pullProgress) String() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.layers) == 0 {
+		return "resolving"
+	}
+	done := 0
+	for _, complete := range p.layers {
+		if complete {
+			done++
+		}
+	}
+	progress := fmt.Sprintf("%d/%d layers", done, len(p.layers))
+	if p.total != "" {
+		progress += fmt.Sprintf(", %s downloaded", p.total)
+	}
+	return progress
+}
@@ -0,0 +1,135 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/spf13/cobra"
+)
+
+var (
+	// pushRegistryAuths are the registry credentials of the push command,
+	// passed as <registry>=<username>:<password>.
+	pushRegistryAuths []string
+)
+
+// pushCmd represents the push command
+var pushCmd = &cobra.Command{
+	Use:   "push <image-name>",
+	Short: "Push a VM image to a registry.",
+	Long: `Push a local VM image or base image to its registry, using the registry
+credentials passed with --registry-auth or found in the docker config.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("require one image name argument")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runPush(args[0], pushRegistryAuths); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+func runPush(image string, auths []string) error {
+	authStore, err := newRegistryAuthStore(auths)
+	if err != nil {
+		return err
+	}
+
+	b, err := newImageBuilder(builderName)
+	if err != nil {
+		return err
+	}
+	defer b.Close()
+
+	_, err = pushImage(b, authStore, image)
+	return err
+}
+
+// pushImage pushes a local image of the builder to its registry and prints the
+// pushed digest. It returns the pushed digest.
+func pushImage(b imageBuilder, authStore *registryAuthStore, image string) (string, error) {
+	registry, auth, err := authStore.authFor(image)
+	if err != nil {
+		return "", fmt.Errorf("failed to get registry credentials for image %q: %v", image, err)
+	}
+
+	fmt.Printf("Pushing image %s...\n", image)
+	pushedDigest, err := b.PushImage(image, auth, registry, os.Stdout)
+	if err != nil {
+		return "", fmt.Errorf("failed to push image %q: %v", image, err)
+	}
+	fmt.Printf("Pushed image %s (digest %s)\n", image, pushedDigest)
+	return pushedDigest, nil
+}
+
+// dockerPushStream parses the docker push JSON message stream. It prints the
+// layer status changes to w, without the progress updates, and records the
+// pushed digest and the first error of the stream.
+type dockerPushStream struct {
+	w io.Writer
+	// partial is the incomplete last line of the stream.
+	partial []byte
+	// digest is the pushed manifest digest.
+	digest string
+	// err is the first error message of the stream.
+	err string
+}
+
+// Write parses the complete messages of the stream.
+func (s *dockerPushStream) Write(b []byte) (int, error) {
+	s.partial = append(s.partial, b...)
+	for {
+		i := bytes.IndexByte(s.partial, '\n')
+		if i < 0 {
+			break
+		}
+		s.parseMessage(s.partial[:i])
+		s.partial = s.partial[i+1:]
+	}
+	return len(b), nil
+}
+
+// parseMessage handles a message of the push stream.
+func (s *dockerPushStream) parseMessage(line []byte) {
+	msg := struct {
+		ID     string `json:"id"`
+		Status string `json:"status"`
+		Error  string `json:"error"`
+		Aux    *struct {
+			Digest string
+		} `json:"aux"`
+	}{}
+	if json.Unmarshal(line, &msg) != nil {
+		return
+	}
+
+	switch {
+	case msg.Error != "":
+		if s.err == "" {
+			s.err = msg.Error
+		}
+	case msg.Aux != nil:
+		if msg.Aux.Digest != "" {
+			s.digest = msg.Aux.Digest
+		}
+	case msg.Status == "Pushing" || msg.Status == "":
+		// Progress updates.
+	case msg.ID != "":
+		fmt.Fprintf(s.w, "  %s: %s\n", msg.ID, msg.Status)
+	default:
+		fmt.Fprintf(s.w, "  %s\n", msg.Status)
+	}
+}
+
+func init() {
+	imageCmd.AddCommand(pushCmd)
+
+	pushCmd.Flags().StringArrayVar(&pushRegistryAuths, "registry-auth", pushRegistryAuths, "Set registry credentials for pushing images (<registry>=<username>:<password>)")
+}
@@ -4,16 +4,20 @@ import (
 	"errors"
 	"fmt"
 	"math/rand"
+	"os"
 	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
 
 	"github.com/joho/godotenv"
+	"github.com/pkg/sftp"
 	"github.com/spf13/cobra"
 	igniteRun "github.com/weaveworks/ignite/cmd/ignite/run"
 	api "github.com/weaveworks/ignite/pkg/apis/ignite"
+	meta "github.com/weaveworks/ignite/pkg/apis/meta/v1alpha1"
 	"github.com/weaveworks/ignite/pkg/client"
 	"github.com/weaveworks/ignite/pkg/constants"
 	"github.com/weaveworks/ignite/pkg/network"
@@ -21,15 +25,16 @@ import (
 	providersIgnite "github.com/weaveworks/ignite/pkg/providers/ignite"
 	"github.com/weaveworks/ignite/pkg/runtime"
 	"github.com/weaveworks/libgitops/pkg/filter"
+	gossh "golang.org/x/crypto/ssh"
 
 	"github.com/darkowlzz/ignite-cntr/ssh"
 )
 
 const (
 	defaultUser = "root"
-	// Any mounts are copied into this directory of the VM and then mounted into
-	// the application container.
-	defaultMountParentDir = "/tmp"
+	// The mount sources are copied into a per-container directory of this
+	// directory of the VM and then mounted into the application container.
+	vmMountDir = "/var/lib/ignite-cntr/mounts"
 )
 
 var (
@@ -45,10 +50,26 @@ var (
 	// appCmdArgs is the arguments to the command passed to a container. A
 	// command must be set for passing the args, else the args will be ignored.
 	appCmdArgs []string
+	// runVolumes are the bind mounts of host files and directories, and the
+	// mounts of named volumes in the application container, in
+	// <host-path|volume-name>:<container-path>[:ro|rw] format.
+	runVolumes []string
 	// mountSrcPath is the path of the source that needs to be mounted.
+	// Deprecated, replaced by runVolumes.
 	mountSrcPath string
 	// mountDestPath is the mount point in the application container.
+	// Deprecated, replaced by runVolumes.
 	mountDestPath string
+	// runPorts are the container ports published on the VM, in
+	// <vm-port>:<container-port>[/tcp|udp] format.
+	runPorts []string
+	// publishHost enables publishing the VM ports of runPorts on the host
+	// through the ignite VM port mappings.
+	publishHost bool
+	// runName is the name of the application container, random if unset.
+	runName string
+	// runReplace enables replacing an existing container with the same name.
+	runReplace bool
 )
 
 // runCmd represents the run command
@@ -100,113 +121,258 @@ func runApp(vmName string, appImage string, appcmd string, appCmdArgs []string,
 		return fmt.Errorf("this command needs to be run as root")
 	}
 
-	// Set default runtime and network plugin.
-	providers.RuntimeName = runtime.RuntimeDocker
-	providers.NetworkPluginName = network.PluginDockerBridge
-
-	// Initialize ignite.
-	if err := providers.Populate(providersIgnite.Preload); err != nil {
-		return fmt.Errorf("failed to initialize ignite preload: %w", err)
+	mounts, volumeMounts, err := parseRunVolumes(runVolumes, mountSrcPath, mountDestPath)
+	if err != nil {
+		return err
 	}
-	if err := providers.Populate(providersIgnite.Providers); err != nil {
-		return fmt.Errorf("failed to initialize ignite providers: %w", err)
+	var ports []appPort
+	for _, p := range runPorts {
+		port, err := parseAppPort(p)
+		if err != nil {
+			return err
+		}
+		ports = append(ports, port)
+	}
+	if netHost && len(ports) > 0 {
+		return fmt.Errorf("--publish can't be used with --net-host, the container ports are the VM ports")
+	}
+	if publishHost && len(ports) == 0 {
+		return fmt.Errorf("--publish-host requires --publish")
+	}
+	if runName != "" && !appNameRegexp.MatchString(runName) {
+		return fmt.Errorf("invalid container name %q, want letters, digits and _.- only", runName)
+	}
+	if runReplace && runName == "" {
+		return fmt.Errorf("--replace requires --name")
+	}
+
+	if err := initIgniteProviders(runtime.RuntimeDocker); err != nil {
+		return err
 	}
 
 	iclient := providers.Client.VMs()
 
+	// Ensure that the VM image can run on this host.
+	vm, err := getVMByName(iclient, vmName)
+	if err != nil {
+		return err
+	}
+	vmLabels := getVMImageLabels(vm)
+	if err := checkVMPlatform(vm, vmLabels); err != nil {
+		return err
+	}
+	// The named volumes are mounted from their mount path in the VM.
+	volumes := map[string]*volume{}
+	for i, m := range volumeMounts {
+		vmPath := vmVolumeMountPath(vm, m.Source)
+		if vmPath == "" {
+			return fmt.Errorf("volume %q is not attached to VM %q, attach it with ignite-cntr volume attach", m.Source, vm.Name)
+		}
+		if volumes[vmPath], err = getVolume(m.Source); err != nil {
+			return err
+		}
+		volumeMounts[i].Source = vmPath
+	}
+
+	// Run the container with the container runtime of the VM image.
+	rt, err := runtimeFromLabels(vmLabels)
+	if err != nil {
+		return fmt.Errorf("invalid VM image of VM %q: %v", vm.Name, err)
+	}
+
 	ip, key, err := getIPAndPrivateKey(iclient, vmName)
 	if err != nil {
 		return err
 	}
 
-	// containerMountSet is used to check if the mount flags must be set when
-	// creating a container.
-	containerMountSet := false
+	name := runName
+	if name == "" {
+		// Generate a random container app name.
+		rand.Seed(time.Now().UnixNano())
+		name = fmt.Sprintf("container-app-%d", rand.Int())
+	}
+	app := appContainer{
+		Name:    name,
+		Image:   appImage,
+		Cmd:     appcmd,
+		Args:    appCmdArgs,
+		Env:     envVars,
+		NetHost: netHost,
+		Ports:   ports,
+	}
 
-	// TODO: Add support for multiple mounts.
-	if mountSrcPath != "" {
-		// Ensure mount destination path is also passed.
-		if mountDestPath == "" {
-			return fmt.Errorf("when mounting, both --mount-src and --mount-dest must be set")
-		}
+	// Run the container through the runtime API of the VM, reached over SSH.
+	sshClient, err := ssh.NewSSHClient(ip, defaultUser, key)
+	if err != nil {
+		return fmt.Errorf("failed to connect to VM %q: %v", vm.Name, err)
+	}
+	defer sshClient.Close()
 
-		if err := copyFileToVM(vmName, mountSrcPath); err != nil {
-			return fmt.Errorf("failed to copy mount-src %q into the VM", mountSrcPath)
+	// The containers run in the namespace of the preloaded images.
+	rtClient, err := newVMRuntimeClient(rt, sshClient, vm.GetUID().String(), namespaceFromLabels(vmLabels))
+	if err != nil {
+		return err
+	}
+	defer rtClient.Close()
+
+	exists, err := rtClient.Exists(app.Name)
+	if err != nil {
+		return err
+	}
+	if exists {
+		if !runReplace {
+			return fmt.Errorf("container %s already exists in VM %q, use --replace to replace it", app.Name, vm.Name)
+		}
+		fmt.Printf("Removing container %s...\n", app.Name)
+		if err := rtClient.RemoveApp(app.Name); err != nil {
+			return err
+		}
+		// Drop the copied mount sources of the replaced container.
+		if err := removeVMMounts(sshClient, app.Name); err != nil {
+			return err
 		}
-		// Set the containerMountSet to true after a successful copy of files to
-		// the VM.
-		containerMountSet = true
 	}
 
-	// Generate a random container app name.
-	rand.Seed(time.Now().UnixNano())
-	appName := fmt.Sprintf("container-app-%d", rand.Int())
+	for vmPath, v := range volumes {
+		if err := mountVolumeInVM(sshClient, v, vmPath); err != nil {
+			return err
+		}
+	}
 
-	var appSetupCmd strings.Builder
+	// Drop the copied mount sources of the removed containers, like the
+	// unnamed containers removed in the VM.
+	if err := removeStaleVMMounts(sshClient, rtClient); err != nil {
+		return err
+	}
 
-	// NOTE: The order of arguments to ctr container create is important.
-	// <image> <container-name> [command] [args] [--env|--net-host|...]
+	// Set the container mounts after a successful copy of files to the VM.
+	if app.Mounts, err = copyMountsToVM(vmName, sshClient, app.Name, mounts); err != nil {
+		removeVMMountsOnError(sshClient, app.Name)
+		return err
+	}
+	app.Mounts = append(app.Mounts, volumeMounts...)
 
-	// Create containerd container command.
-	//   ctr -n <namespace> container create <image> <container-name>
-	createContainer := fmt.Sprintf(`%s -n %s container create %s %s`, ctrPath, containerdNamespace, appImage, appName)
-	appSetupCmd.WriteString(createContainer)
+	fmt.Printf("Running container %s with %s...\n", app.Name, rt.Name())
+	if err := rtClient.RunApp(app); err != nil {
+		removeVMMountsOnError(sshClient, app.Name)
+		return err
+	}
+	fmt.Printf("Started container %s\n", app.Name)
 
-	// Set the container command if provided.
-	if appCmd != "" {
-		appSetupCmd.WriteString(fmt.Sprintf(" %s", appCmd))
+	if publishHost {
+		return publishVMPorts(iclient, vm, ports)
+	}
+	return nil
+}
 
-		// Pass the command arguments.
-		for _, arg := range appCmdArgs {
-			appSetupCmd.WriteString(fmt.Sprintf(" %s", arg))
+// publishVMPorts adds the mappings of the VM ports of the published ports to
+// the host ports of the same number, to the VM spec. ignite maps the VM ports
+// when the VM starts, the new mappings are applied at the next VM start.
+func publishVMPorts(iclient client.VMClient, vm *api.VM, ports []appPort) error {
+	var added meta.PortMappings
+	for _, p := range ports {
+		protocol := meta.Protocol(p.Protocol)
+		if m, ok := findVMPortMapping(vm.Spec.Network.Ports, uint64(p.VMPort), protocol); ok {
+			fmt.Printf("VM port %d/%s is published on host port %d\n", p.VMPort, p.Protocol, m.HostPort)
+			continue
 		}
+		added = append(added, meta.PortMapping{
+			HostPort: uint64(p.VMPort),
+			VMPort:   uint64(p.VMPort),
+			Protocol: protocol,
+		})
 	}
-
-	// Set the container environment variables.
-	for _, envVar := range envVars {
-		env := fmt.Sprintf(" --env %s", envVar)
-		appSetupCmd.WriteString(env)
+	if len(added) == 0 {
+		return nil
 	}
 
-	// Enable host networking for the container if requested.
-	if netHost {
-		appSetupCmd.WriteString(" --net-host")
+	vm.Spec.Network.Ports = append(vm.Spec.Network.Ports, added...)
+	if err := iclient.Set(vm); err != nil {
+		return fmt.Errorf("failed to update the port mappings of VM %q: %v", vm.Name, err)
 	}
+	fmt.Printf("Added the host port mappings %s to VM %s, restart the VM to apply them\n", added, vm.Name)
+	return nil
+}
 
-	// Set mount flags. Source is the path in the VM, destination is the path
-	// in the application container.
-	if containerMountSet {
-		mntSrc := filepath.Join(defaultMountParentDir, filepath.Base(mountSrcPath))
-		mountFlag := fmt.Sprintf(" --mount=\"src=%s,dst=%s,type=bind,options=rbind:ro\"", mntSrc, mountDestPath)
-		appSetupCmd.WriteString(mountFlag)
+// findVMPortMapping returns the port mapping of a VM port. The mappings with
+// no protocol are tcp.
+func findVMPortMapping(mappings meta.PortMappings, vmPort uint64, protocol meta.Protocol) (meta.PortMapping, bool) {
+	for _, m := range mappings {
+		mProtocol := m.Protocol
+		if mProtocol == "" {
+			mProtocol = meta.ProtocolTCP
+		}
+		if m.VMPort == vmPort && mProtocol == protocol {
+			return m, true
+		}
 	}
+	return meta.PortMapping{}, false
+}
 
-	fmt.Printf("Creating container %s...\n", appName)
-	fmt.Println("CMD:", appSetupCmd.String())
-	if err = runCmdInVM(ip, key, appSetupCmd.String()); err != nil {
-		return err
+// getVMImageLabels returns the labels of the VM image of a VM, inspected in the
+// ignite runtime of the VM that imported the image: docker, or the host
+// containerd in the ignite namespace. nil is returned if the image can't be
+// inspected.
+func getVMImageLabels(vm *api.VM) map[string]string {
+	image := vm.Spec.Image.OCI.String()
+	labels, err := inspectVMImageLabels(vm, image)
+	if err != nil {
+		// The image labels are only used for checks and defaults, let the
+		// container run fail on mismatch.
+		fmt.Printf("Failed to inspect VM image %q, using defaults: %v\n", image, err)
+		return nil
 	}
+	return labels
+}
 
-	fmt.Printf("Running task %s...\n", appName)
-	// Run containerd container task.
-	appRunCmd := fmt.Sprintf(`ctr -n ignite task start -d %s`, appName)
-	return runCmdInVM(ip, key, appRunCmd)
+// namespaceFromLabels returns the runtime namespace of the preloaded images of
+// a VM image from the image labels. Images without the namespace label use the
+// default namespace.
+func namespaceFromLabels(labels map[string]string) string {
+	if ns := labels[namespaceLabel]; ns != "" {
+		return ns
+	}
+	return containerdNamespace
 }
 
-// runCmdInVM takes a VM IP, ssh key and runs the given command in the VM.
-func runCmdInVM(ip, key, cmd string) error {
-	cmdOut, cmdErr, err := ssh.RunSSHCommand(ip, defaultUser, key, cmd)
+// inspectVMImageLabels returns the labels of an image in the ignite runtime of
+// a VM.
+func inspectVMImageLabels(vm *api.VM, image string) (map[string]string, error) {
+	var b imageBuilder
+	var err error
+	if vm.Status.Runtime != nil && vm.Status.Runtime.Name == runtime.RuntimeContainerd {
+		b, err = newContainerdBuilder(defaultContainerdAddress, defaultContainerdBuildNamespace)
+	} else {
+		b, err = newImageBuilder(builderDocker)
+	}
 	if err != nil {
-		return err
+		return nil, err
 	}
+	defer b.Close()
 
-	// Print the command stdout and stderr.
-	fmt.Printf("[STDOUT]:\n%s\n", cmdOut)
+	img, err := b.InspectImage(image)
+	if err != nil {
+		return nil, err
+	}
+	return img.Labels, nil
+}
 
-	if len(cmdErr) > 0 {
-		fmt.Printf("[STDERR]:\n%s\n", cmdErr)
+// initIgniteProviders initializes the ignite providers with the given runtime
+// and its default network plugin.
+func initIgniteProviders(rtName runtime.Name) error {
+	providers.RuntimeName = rtName
+	providers.NetworkPluginName = network.PluginDockerBridge
+	if rtName == runtime.RuntimeContainerd {
+		providers.NetworkPluginName = network.PluginCNI
 	}
 
+	// Initialize ignite.
+	if err := providers.Populate(providersIgnite.Preload); err != nil {
+		return fmt.Errorf("failed to initialize ignite preload: %w", err)
+	}
+	if err := providers.Populate(providersIgnite.Providers); err != nil {
+		return fmt.Errorf("failed to initialize ignite providers: %w", err)
+	}
 	return nil
 }
 
@@ -235,23 +401,151 @@ func getVMByName(iclient client.VMClient, name string) (*api.VM, error) {
 	return iclient.Find(filter.NewIDNameFilter(name))
 }
 
-// copyFileToVM copies a file into a given VM.
-func copyFileToVM(vmName, source string) error {
+// parseRunVolumes parses the mounts of the volumes flags and the deprecated
+// mount-src and mount-dest flags. It returns the bind mounts of host paths and
+// the mounts of named volumes, with the volume name as source. The relative
+// host paths of the deprecated flags are made absolute.
+func parseRunVolumes(volumes []string, mountSrc, mountDest string) ([]appMount, []appMount, error) {
+	var mounts, volumeMounts []appMount
+	for _, v := range volumes {
+		// Like docker, a source that isn't a path is a volume name.
+		if name := strings.SplitN(v, ":", 2)[0]; !path.IsAbs(name) && volumeNameRegexp.MatchString(name) {
+			m, err := parseAppMount(path.Join(vmVolumeDir, v))
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid volume mount %q, want <volume-name>:<container-path>[:ro|rw]", v)
+			}
+			m.Source = name
+			volumeMounts = append(volumeMounts, m)
+			continue
+		}
+		m, err := parseAppMount(v)
+		if err != nil {
+			return nil, nil, err
+		}
+		mounts = append(mounts, m)
+	}
+
+	if mountSrc != "" {
+		// Ensure mount destination path is also passed.
+		if mountDest == "" {
+			return nil, nil, fmt.Errorf("when mounting, both --mount-src and --mount-dest must be set")
+		}
+		src, err := filepath.Abs(mountSrc)
+		if err != nil {
+			return nil, nil, err
+		}
+		mounts = append(mounts, appMount{Source: src, Destination: mountDest, ReadOnly: true})
+	}
+	return mounts, volumeMounts, nil
+}
+
+// copyMountsToVM copies the host sources of the bind mounts into the directory
+// of the container in the VM and returns the mounts of the copies. Each source
+// gets its own directory, the sources with the same name don't collide.
+func copyMountsToVM(vmName string, sshClient *gossh.Client, containerName string, mounts []appMount) ([]appMount, error) {
+	if len(mounts) == 0 {
+		return nil, nil
+	}
+
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	defer sftpClient.Close()
+
+	var vmMounts []appMount
+	for i, m := range mounts {
+		dir := path.Join(vmMountDir, containerName, strconv.Itoa(i))
+		if err := sftpClient.MkdirAll(dir); err != nil {
+			return nil, fmt.Errorf("failed to create directory %q in the VM: %v", dir, err)
+		}
+		vmPath := path.Join(dir, filepath.Base(m.Source))
+		fmt.Printf("Copying %s to %s in the VM...\n", m.Source, vmPath)
+		if err := copyToVM(vmName, m.Source, vmPath); err != nil {
+			return nil, fmt.Errorf("failed to copy %q into the VM: %v", m.Source, err)
+		}
+		m.Source = vmPath
+		vmMounts = append(vmMounts, m)
+	}
+	return vmMounts, nil
+}
+
+// removeVMMounts removes the directory of the copied mount sources of a
+// container in the VM.
+func removeVMMounts(sshClient *gossh.Client, containerName string) error {
+	dir := path.Join(vmMountDir, containerName)
+	if err := runInVM(sshClient, "rm -rf "+shellQuote(dir)); err != nil {
+		return fmt.Errorf("failed to remove directory %q in the VM: %v", dir, err)
+	}
+	return nil
+}
+
+// removeVMMountsOnError removes the copied mount sources of a container that
+// failed to run. The cleanup error is printed, the run error is returned.
+func removeVMMountsOnError(sshClient *gossh.Client, containerName string) {
+	if err := removeVMMounts(sshClient, containerName); err != nil {
+		fmt.Printf("Warning: %v\n", err)
+	}
+}
+
+// removeStaleVMMounts removes the directories of the copied mount sources of
+// the containers that no longer exist in the VM.
+func removeStaleVMMounts(sshClient *gossh.Client, rtClient vmRuntimeClient) error {
+	sftpClient, err := sftp.NewClient(sshClient)
+	if err != nil {
+		return fmt.Errorf("failed to create sftp client: %v", err)
+	}
+	defer sftpClient.Close()
+
+	entries, err := sftpClient.ReadDir(vmMountDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("failed to read directory %q in the VM: %v", vmMountDir, err)
+	}
+	for _, entry := range entries {
+		exists, err := rtClient.Exists(entry.Name())
+		if err != nil {
+			return err
+		}
+		if exists {
+			continue
+		}
+		if err := removeVMMounts(sshClient, entry.Name()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// runInVM runs a shell command in the VM. The error has the command output.
+func runInVM(sshClient *gossh.Client, cmd string) error {
+	session, err := sshClient.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+
+	if output, err := session.CombinedOutput(cmd); err != nil {
+		return fmt.Errorf("%v: %s", err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// copyToVM copies a file or directory into a given VM at dest.
+func copyToVM(vmName, source, dest string) error {
 	// Construct destination path: <vm-name>:<path-in-vm>
-	destPath := filepath.Join(defaultMountParentDir, filepath.Base(source))
-	dest := fmt.Sprintf("%s:%s", vmName, destPath)
+	vmDest := fmt.Sprintf("%s:%s", vmName, dest)
 
 	// Create ignite copy options with source and destination.
 	cpFlags := igniteRun.CPFlags{}
-	copyOpts, err := cpFlags.NewCPOptions(source, dest)
+	copyOpts, err := cpFlags.NewCPOptions(source, vmDest)
 	if err != nil {
 		return err
 	}
 
-	if err := igniteRun.CP(copyOpts); err != nil {
-		return err
-	}
-	return nil
+	return igniteRun.CP(copyOpts)
 }
 
 func init() {
@@ -267,11 +561,18 @@ func init() {
 	// is called directly, e.g.:
 	// runCmd.Flags().BoolP("toggle", "t", false, "Help message for toggle")
 
+	runCmd.Flags().StringVar(&runName, "name", "", "Name of the app container (default is a random container-app-<number> name)")
+	runCmd.Flags().BoolVar(&runReplace, "replace", false, "Replace the container with the same --name, stopping and removing it first")
 	runCmd.Flags().StringArrayVarP(&appEnvVars, "env", "e", appEnvVars, "Set environment variables for the app container (SOME_VAR=someval)")
 	runCmd.Flags().BoolVar(&netHost, "net-host", false, "Enable host networking for the container")
 	runCmd.Flags().StringArrayVar(&envFile, "env-file", envFile, "Read in a file of environment variables")
 	runCmd.Flags().StringVarP(&appCmd, "cmd", "c", "", "Command passed to the container app")
 	runCmd.Flags().StringArrayVarP(&appCmdArgs, "arg", "a", appCmdArgs, "Arguments to the command passed to the container app")
+	runCmd.Flags().StringArrayVarP(&runVolumes, "volume", "v", runVolumes, "Bind mount a host file or directory, or mount a named volume in the app container (<host-path|volume-name>:<container-path>[:ro|rw])")
 	runCmd.Flags().StringVar(&mountSrcPath, "mount-src", "", "local path that needs to be mounted in the application container")
 	runCmd.Flags().StringVar(&mountDestPath, "mount-dest", "", "path in the application container where the source path is mounted")
+	runCmd.Flags().StringArrayVarP(&runPorts, "publish", "p", runPorts, "Publish a container port on the VM (<vm-port>:<container-port>[/tcp|udp])")
+	runCmd.Flags().BoolVar(&publishHost, "publish-host", false, "Also publish the VM ports of --publish on the same host ports, applied at the next VM start")
+	runCmd.Flags().MarkDeprecated("mount-src", "use --volume <host-path>:<container-path>:ro instead")
+	runCmd.Flags().MarkDeprecated("mount-dest", "use --volume <host-path>:<container-path>:ro instead")
 }
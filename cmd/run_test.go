@@ -0,0 +1,144 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestParseAppMount(t *testing.T) {
+	tests := []struct {
+		mount   string
+		want    appMount
+		wantErr bool
+	}{
+		{mount: "/src:/dest", want: appMount{Source: "/src", Destination: "/dest"}},
+		{mount: "/src:/dest:ro", want: appMount{Source: "/src", Destination: "/dest", ReadOnly: true}},
+		{mount: "/src:/dest:rw", want: appMount{Source: "/src", Destination: "/dest"}},
+		{mount: "/src:/dest:rx", wantErr: true},
+		{mount: "src:/dest", wantErr: true},
+		{mount: "/src:dest", wantErr: true},
+		{mount: "/src", wantErr: true},
+		{mount: "/src:/dest:ro:rw", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.mount, func(t *testing.T) {
+			got, err := parseAppMount(tt.mount)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseRunVolumes(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name             string
+		volumes          []string
+		mountSrc         string
+		mountDest        string
+		wantMounts       []appMount
+		wantVolumeMounts []appMount
+		wantErr          bool
+	}{
+		{
+			name:       "bind mounts",
+			volumes:    []string{"/etc/app.conf:/etc/app.conf:ro", "/data:/data"},
+			wantMounts: []appMount{{Source: "/etc/app.conf", Destination: "/etc/app.conf", ReadOnly: true}, {Source: "/data", Destination: "/data"}},
+		},
+		{
+			name:             "named volumes",
+			volumes:          []string{"data:/data", "logs:/var/log:ro"},
+			wantVolumeMounts: []appMount{{Source: "data", Destination: "/data"}, {Source: "logs", Destination: "/var/log", ReadOnly: true}},
+		},
+		{
+			name:             "bind mount and named volume",
+			volumes:          []string{"/data:/data", "logs:/var/log"},
+			wantMounts:       []appMount{{Source: "/data", Destination: "/data"}},
+			wantVolumeMounts: []appMount{{Source: "logs", Destination: "/var/log"}},
+		},
+		{
+			name:    "relative source",
+			volumes: []string{"./data:/data"},
+			wantErr: true,
+		},
+		{
+			name:    "relative destination",
+			volumes: []string{"/data:data"},
+			wantErr: true,
+		},
+		{
+			name:    "named volume relative destination",
+			volumes: []string{"data:data"},
+			wantErr: true,
+		},
+		{
+			name:    "named volume unknown mode",
+			volumes: []string{"data:/data:rx"},
+			wantErr: true,
+		},
+		{
+			name:       "deprecated flags",
+			mountSrc:   "/src",
+			mountDest:  "/dest",
+			wantMounts: []appMount{{Source: "/src", Destination: "/dest", ReadOnly: true}},
+		},
+		{
+			name:       "deprecated flags relative source",
+			mountSrc:   "src",
+			mountDest:  "/dest",
+			wantMounts: []appMount{{Source: filepath.Join(wd, "src"), Destination: "/dest", ReadOnly: true}},
+		},
+		{
+			name:     "deprecated flags without destination",
+			mountSrc: "/src",
+			wantErr:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			mounts, volumeMounts, err := parseRunVolumes(tt.volumes, tt.mountSrc, tt.mountDest)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if tt.wantErr {
+				return
+			}
+			if !reflect.DeepEqual(mounts, tt.wantMounts) {
+				t.Errorf("got mounts %+v, want %+v", mounts, tt.wantMounts)
+			}
+			if !reflect.DeepEqual(volumeMounts, tt.wantVolumeMounts) {
+				t.Errorf("got volume mounts %+v, want %+v", volumeMounts, tt.wantVolumeMounts)
+			}
+		})
+	}
+}
+
+func TestNamespaceFromLabels(t *testing.T) {
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   string
+	}{
+		{name: "no labels", want: containerdNamespace},
+		{name: "no namespace label", labels: map[string]string{runtimeLabel: runtimeContainerd}, want: containerdNamespace},
+		{name: "empty namespace label", labels: map[string]string{namespaceLabel: ""}, want: containerdNamespace},
+		{name: "custom namespace", labels: map[string]string{namespaceLabel: "apps"}, want: "apps"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := namespaceFromLabels(tt.labels); got != tt.want {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
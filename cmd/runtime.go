@@ -0,0 +1,489 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+const (
+	// runtimeContainerd is the containerd container runtime.
+	runtimeContainerd = "containerd"
+	// runtimeDocker is the docker engine container runtime.
+	runtimeDocker = "docker"
+
+	// defaultContainerRuntime is the container runtime used when the base
+	// image has no runtime label.
+	defaultContainerRuntime = runtimeContainerd
+
+	dockerPath = "/usr/bin/docker"
+
+	// gcLeaseID is the ID of the temporary containerd lease removed to run
+	// the garbage collection.
+	gcLeaseID = "ignite-cntr-gc"
+)
+
+// containerRuntime is a container runtime installed in the VM images. It
+// provides the commands to load images in the build container and to run
+// containers in the VM.
+type containerRuntime interface {
+	// Name returns the name of the runtime.
+	Name() string
+	// Packages returns the apt packages that install the runtime, with the
+	// runtime package pinned to the given version if set.
+	Packages(version string) []string
+	// InstallScript returns the shell script installing the runtime files
+	// that aren't packaged, run after the packages install. Empty if none.
+	InstallScript() string
+	// ConfigPath returns the path of the runtime config file.
+	ConfigPath() string
+	// DaemonCmd returns the command that runs the runtime daemon.
+	DaemonCmd() []string
+	// VersionCmd returns a command that succeeds when the daemon is ready.
+	VersionCmd() []string
+	// SetupCmd returns the command to prepare the runtime to load the images
+	// in the given namespace. nil if there's nothing to prepare.
+	SetupCmd(namespace string) []string
+	// PullCmd returns the command to pull an image.
+	PullCmd(opts pullOptions) []string
+	// PinImageCmds returns the commands to name an image pulled by the pinned
+	// <name>@<digest> reference with its reference ref.
+	PinImageCmds(namespace, pinned, ref string) [][]string
+	// ImportCmd returns the command to import an image archive. An archive
+	// path "-" reads the archive from stdin.
+	ImportCmd(namespace, archivePath, indexName string) []string
+	// ListImagesCmd returns the command to list the images.
+	ListImagesCmd(namespace string) []string
+	// RemoveImageCmd returns the command to remove an image.
+	RemoveImageCmd(namespace, ref string) []string
+	// ParseImages parses the output of the list images command and returns
+	// the images keyed by normalized image reference.
+	ParseImages(output []byte) map[string]runtimeImage
+	// GCCmds returns the commands to remove the unused data of the runtime.
+	// If dropBlobs is set, the compressed layer blobs of the unpacked images
+	// are removed too. Runtimes that don't keep the blobs ignore dropBlobs.
+	GCCmds(namespace string, dropBlobs bool) [][]string
+	// AppService returns the systemd service running a container in the
+	// foreground, to start it at VM boot.
+	AppService(namespace string, app appContainer) appService
+}
+
+// pullOptions are the options of an image pull command.
+type pullOptions struct {
+	// Namespace is the namespace the image is pulled into.
+	Namespace string
+	// Platform is the platform of the image. Empty for the runtime default.
+	Platform string
+	// Image is the image to be pulled.
+	Image imageSpec
+	// Registry is the registry host of the image.
+	Registry string
+	// Auth enables reading the registry credentials from registryAuthEnv.
+	Auth bool
+	// Digest is the locked digest of the image. Empty to pull by reference.
+	Digest string
+}
+
+// runtimeImage is an image in a container runtime.
+type runtimeImage struct {
+	Ref    string
+	Digest string
+	Size   string
+}
+
+// appContainer is the configuration of an application container run in a VM.
+type appContainer struct {
+	// Name is the name of the container.
+	Name string
+	// Image is the image of the container.
+	Image string
+	// Cmd is the command passed to the container, optional.
+	Cmd string
+	// Args are the arguments of the command.
+	Args []string
+	// Env are the environment variables in KEY=value format.
+	Env []string
+	// NetHost enables host networking.
+	NetHost bool
+	// Mounts are the bind mounts of VM paths in the container.
+	Mounts []appMount
+	// Ports are the container ports published on the VM, without host
+	// networking.
+	Ports []appPort
+}
+
+// appMount is a bind mount of a VM path in an application container.
+type appMount struct {
+	// Source is the path in the VM.
+	Source string
+	// Destination is the path in the container.
+	Destination string
+	// ReadOnly mounts the source read-only.
+	ReadOnly bool
+}
+
+// appPort is a port of an application container published on a VM port.
+type appPort struct {
+	// VMPort is the port in the VM.
+	VMPort uint16 `json:"vmPort"`
+	// ContainerPort is the port in the container.
+	ContainerPort uint16 `json:"containerPort"`
+	// Protocol is the port protocol, tcp or udp.
+	Protocol string `json:"protocol"`
+}
+
+// appService is a systemd service running an application container.
+type appService struct {
+	// Requires is the systemd unit of the runtime daemon.
+	Requires string
+	// ExecStartPre are the commands removing a container left by an unclean
+	// shutdown. Their failures are ignored.
+	ExecStartPre [][]string
+	// ExecStart is the command running the container in the foreground.
+	ExecStart []string
+	// ExecStop is the command stopping the container.
+	ExecStop []string
+}
+
+// containerRuntimes are the supported container runtimes keyed by name.
+var containerRuntimes = map[string]containerRuntime{
+	runtimeContainerd: containerdRuntime{},
+	runtimeDocker:     dockerRuntime{},
+}
+
+// getContainerRuntime returns the container runtime with the given name.
+func getContainerRuntime(name string) (containerRuntime, error) {
+	rt, ok := containerRuntimes[name]
+	if !ok {
+		return nil, fmt.Errorf("unsupported container runtime %q, supported runtimes: %s", name, strings.Join(containerRuntimeNames(), ", "))
+	}
+	return rt, nil
+}
+
+// runtimeFromLabels returns the container runtime of an image from the image
+// labels. Images without the runtime label use the default runtime.
+func runtimeFromLabels(labels map[string]string) (containerRuntime, error) {
+	name := labels[runtimeLabel]
+	if name == "" {
+		name = defaultContainerRuntime
+	}
+	return getContainerRuntime(name)
+}
+
+// containerRuntimeNames returns the sorted names of the supported runtimes.
+func containerRuntimeNames() []string {
+	names := []string{}
+	for name := range containerRuntimes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// parseImageLines parses image list output with a line per image, made of at
+// least nFields whitespace separated fields, using info to extract the image
+// from the fields. The first line is skipped if header is true. Malformed
+// lines are skipped.
+func parseImageLines(output []byte, header bool, nFields int, info func(fields []string) runtimeImage) map[string]runtimeImage {
+	images := map[string]runtimeImage{}
+	lines := strings.Split(strings.TrimSpace(string(output)), "\n")
+	if header {
+		lines = lines[1:]
+	}
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) < nFields {
+			continue
+		}
+		img := info(fields)
+		images[normalizeImageRef(img.Ref)] = img
+	}
+	return images
+}
+
+// aptPackage returns the apt package specifier of a package, pinned to the
+// given version if set.
+func aptPackage(name, version string) string {
+	if version == "" {
+		return name
+	}
+	return fmt.Sprintf("%s=%s", name, version)
+}
+
+// containerdRuntime is the containerd container runtime, used through ctr.
+type containerdRuntime struct{}
+
+func (containerdRuntime) Name() string { return runtimeContainerd }
+
+func (containerdRuntime) Packages(version string) []string {
+	// curl and ca-certificates download the CNI plugins, and iptables is
+	// used by the bridge and portmap plugins.
+	return []string{aptPackage("containerd", version), "ca-certificates", "curl", "iptables"}
+}
+
+func (containerdRuntime) InstallScript() string {
+	// The CNI plugins of the app container networks aren't packaged in the
+	// base distribution. The CNI release architectures are the Debian ones,
+	// except for arm.
+	return fmt.Sprintf(`mkdir -p %[1]s \
+	&& arch="$(dpkg --print-architecture | sed 's/^armhf$/arm/')" \
+	&& curl -fsSL "https://github.com/containernetworking/plugins/releases/download/%[2]s/cni-plugins-linux-${arch}-%[2]s.tgz" \
+		| tar -xz -C %[1]s`, vmCNIBinDir, cniPluginsVersion)
+}
+
+func (containerdRuntime) ConfigPath() string { return "/etc/containerd/config.toml" }
+
+func (containerdRuntime) DaemonCmd() []string {
+	return []string{"/usr/bin/containerd", "&"}
+}
+
+func (containerdRuntime) VersionCmd() []string {
+	return []string{ctrPath, "version"}
+}
+
+func (containerdRuntime) SetupCmd(namespace string) []string {
+	return []string{ctrPath, "namespace", "create", namespace}
+}
+
+func (containerdRuntime) PullCmd(opts pullOptions) []string {
+	cmd := []string{ctrPath, fmt.Sprintf("--namespace=%s", opts.Namespace), "image", "pull"}
+	if opts.Platform != "" {
+		cmd = append(cmd, "--platform", opts.Platform)
+	}
+	if opts.Image.PlainHTTP {
+		cmd = append(cmd, "--plain-http")
+	}
+	if opts.Image.SkipVerify {
+		cmd = append(cmd, "--skip-verify")
+	}
+	if !opts.Auth {
+		return append(cmd, opts.Image.Name)
+	}
+
+	// Pass the credentials from the environment, keeping them out of the exec
+	// command which is visible in the docker API and events.
+	script := fmt.Sprintf(`ref="$1"; shift; exec "$@" --user "$%s" "$ref"`, registryAuthEnv)
+	return append([]string{"sh", "-c", script, "sh", opts.Image.Name}, cmd...)
+}
+
+func (containerdRuntime) PinImageCmds(namespace, pinned, ref string) [][]string {
+	ns := fmt.Sprintf("--namespace=%s", namespace)
+	return [][]string{
+		{ctrPath, ns, "image", "tag", "--force", pinned, ref},
+		// Drop the pinned name, the image is listed by ref.
+		{ctrPath, ns, "image", "rm", pinned},
+	}
+}
+
+func (containerdRuntime) ImportCmd(namespace, archivePath, indexName string) []string {
+	cmd := []string{ctrPath, fmt.Sprintf("--namespace=%s", namespace), "image", "import"}
+	if indexName != "" {
+		cmd = append(cmd, "--index-name", indexName)
+	}
+	return append(cmd, archivePath)
+}
+
+func (containerdRuntime) ListImagesCmd(namespace string) []string {
+	return []string{ctrPath, fmt.Sprintf("--namespace=%s", namespace), "image", "ls"}
+}
+
+func (containerdRuntime) RemoveImageCmd(namespace, ref string) []string {
+	// Wait for the garbage collection to remove the unused content before
+	// the image is committed.
+	return []string{ctrPath, fmt.Sprintf("--namespace=%s", namespace), "image", "rm", "--sync", ref}
+}
+
+func (containerdRuntime) ParseImages(output []byte) map[string]runtimeImage {
+	// REF TYPE DIGEST SIZE PLATFORMS LABELS, with SIZE of the form
+	// "<value> <unit>".
+	return parseImageLines(output, true, 5, func(fields []string) runtimeImage {
+		return runtimeImage{
+			Ref:    fields[0],
+			Digest: fields[2],
+			Size:   fields[3] + " " + fields[4],
+		}
+	})
+}
+
+func (containerdRuntime) GCCmds(namespace string, dropBlobs bool) [][]string {
+	ns := fmt.Sprintf("--namespace=%s", namespace)
+	var cmds [][]string
+	if dropBlobs {
+		// Drop the references of the images to their layers, the layers are
+		// unpacked in the snapshots.
+		cmds = append(cmds, []string{ctrPath, ns, "content", "prune", "references"})
+	}
+	// Removing a lease synchronously runs the garbage collection.
+	return append(cmds,
+		[]string{ctrPath, ns, "leases", "create", "--id", gcLeaseID},
+		[]string{ctrPath, ns, "leases", "delete", "--sync", gcLeaseID},
+	)
+}
+
+func (containerdRuntime) AppService(namespace string, app appContainer) appService {
+	ns := fmt.Sprintf("--namespace=%s", namespace)
+
+	// ctr run [flags] <image> <container-name> [command] [args]
+	run := []string{ctrPath, ns, "run", "--rm"}
+	for _, envVar := range app.Env {
+		run = append(run, "--env", envVar)
+	}
+	if app.NetHost {
+		run = append(run, "--net-host")
+	}
+	for _, m := range app.Mounts {
+		run = append(run, "--mount", ctrMountOption(m))
+	}
+	run = append(run, app.Image, app.Name)
+	if app.Cmd != "" {
+		run = append(append(run, app.Cmd), app.Args...)
+	}
+
+	return appService{
+		Requires: "containerd.service",
+		ExecStartPre: [][]string{
+			{ctrPath, ns, "task", "rm", "--force", app.Name},
+			{ctrPath, ns, "container", "rm", app.Name},
+		},
+		ExecStart: run,
+		ExecStop:  []string{ctrPath, ns, "task", "kill", app.Name},
+	}
+}
+
+// dockerRuntime is the docker engine container runtime. Docker has no
+// namespaces, the namespace arguments are ignored.
+type dockerRuntime struct{}
+
+func (dockerRuntime) Name() string { return runtimeDocker }
+
+func (dockerRuntime) Packages(version string) []string {
+	return []string{aptPackage("docker.io", version)}
+}
+
+func (dockerRuntime) InstallScript() string { return "" }
+
+func (dockerRuntime) ConfigPath() string { return "/etc/docker/daemon.json" }
+
+func (dockerRuntime) DaemonCmd() []string {
+	return []string{"/usr/bin/dockerd"}
+}
+
+func (dockerRuntime) VersionCmd() []string {
+	return []string{dockerPath, "version"}
+}
+
+func (dockerRuntime) SetupCmd(namespace string) []string { return nil }
+
+func (dockerRuntime) PullCmd(opts pullOptions) []string {
+	cmd := []string{dockerPath, "pull"}
+	if opts.Platform != "" {
+		cmd = append(cmd, "--platform", opts.Platform)
+	}
+	cmd = append(cmd, opts.Image.Name)
+	if !opts.Auth {
+		return cmd
+	}
+
+	// Log in with a temporary docker config, removed after the pull to keep
+	// the credentials out of the VM image.
+	script := fmt.Sprintf(`export DOCKER_CONFIG="$(mktemp -d)"
+printf '%%s' "${%[1]s#*:}" | %[2]s login --username "${%[1]s%%%%:*}" --password-stdin "$1" >/dev/null
+rc=$?
+if [ $rc -eq 0 ]; then
+	shift
+	"$@"
+	rc=$?
+fi
+rm -rf "$DOCKER_CONFIG"
+exit $rc`, registryAuthEnv, dockerPath)
+	return append([]string{"sh", "-c", script, "sh", opts.Registry}, cmd...)
+}
+
+func (dockerRuntime) PinImageCmds(namespace, pinned, ref string) [][]string {
+	return [][]string{{dockerPath, "tag", pinned, ref}}
+}
+
+func (dockerRuntime) ImportCmd(namespace, archivePath, indexName string) []string {
+	// docker load reads from stdin without an input file.
+	cmd := []string{dockerPath, "load"}
+	if archivePath != "-" {
+		cmd = append(cmd, "--input", archivePath)
+	}
+	return cmd
+}
+
+func (dockerRuntime) ListImagesCmd(namespace string) []string {
+	return []string{dockerPath, "image", "ls", "--format", "{{.Repository}}:{{.Tag}} {{.Repository}}@{{.Digest}} {{.Size}}"}
+}
+
+func (dockerRuntime) RemoveImageCmd(namespace, ref string) []string {
+	return []string{dockerPath, "image", "rm", ref}
+}
+
+func (dockerRuntime) ParseImages(output []byte) map[string]runtimeImage {
+	// REPOSITORY:TAG REPOSITORY@DIGEST SIZE. Images pulled by digest have no
+	// tag and are listed by their digest reference, loaded and built images
+	// have no registry digest.
+	return parseImageLines(output, false, 3, func(fields []string) runtimeImage {
+		img := runtimeImage{
+			Ref:    fields[0],
+			Digest: fields[1][strings.LastIndex(fields[1], "@")+1:],
+			Size:   fields[2],
+		}
+		if img.Digest == "<none>" {
+			img.Digest = ""
+		}
+		if strings.HasSuffix(img.Ref, ":<none>") && img.Digest != "" {
+			img.Ref = fields[1]
+		}
+		return img
+	})
+}
+
+func (dockerRuntime) GCCmds(namespace string, dropBlobs bool) [][]string {
+	// docker only keeps the unpacked layers.
+	return [][]string{{dockerPath, "image", "prune", "--force"}}
+}
+
+func (dockerRuntime) AppService(namespace string, app appContainer) appService {
+	// docker run [flags] <image> [command] [args]
+	run := []string{dockerPath, "run", "--rm", "--name", app.Name}
+	for _, envVar := range app.Env {
+		run = append(run, "--env", envVar)
+	}
+	if app.NetHost {
+		run = append(run, "--net", "host")
+	}
+	for _, m := range app.Mounts {
+		run = append(run, "--mount", dockerMountOption(m))
+	}
+	run = append(run, app.Image)
+	if app.Cmd != "" {
+		run = append(append(run, app.Cmd), app.Args...)
+	}
+
+	return appService{
+		Requires:     "docker.service",
+		ExecStartPre: [][]string{{dockerPath, "rm", "--force", app.Name}},
+		ExecStart:    run,
+		ExecStop:     []string{dockerPath, "stop", app.Name},
+	}
+}
+
+// ctrMountOption returns the ctr --mount option of a bind mount.
+func ctrMountOption(m appMount) string {
+	mode := "rw"
+	if m.ReadOnly {
+		mode = "ro"
+	}
+	return fmt.Sprintf("type=bind,src=%s,dst=%s,options=rbind:%s", m.Source, m.Destination, mode)
+}
+
+// dockerMountOption returns the docker --mount option of a bind mount.
+func dockerMountOption(m appMount) string {
+	opt := fmt.Sprintf("type=bind,src=%s,dst=%s", m.Source, m.Destination)
+	if m.ReadOnly {
+		opt += ",readonly"
+	}
+	return opt
+}
@@ -0,0 +1,271 @@
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	// vmImageSpecVersion is the version of the VM image build spec supported
+	// by this version of ignite-cntr.
+	vmImageSpecVersion = "v1alpha1"
+)
+
+// vmImageSpec is a declarative description of a VM image build.
+type vmImageSpec struct {
+	// Version is the version of the spec format.
+	Version string `json:"version"`
+	// Name is the name of the resulting VM image, without the tag.
+	Name string `json:"name"`
+	// Tag is the tag of the resulting VM image.
+	Tag string `json:"tag"`
+	// BaseImage is the image used to create the build container.
+	BaseImage string `json:"baseImage"`
+	// From is an existing VM image the build starts from instead of the base
+	// image. Only the images missing in it are pulled.
+	From string `json:"from"`
+	// Platform is the platform of the VM image, in <os>/<arch>[/<variant>]
+	// format. Defaults to the platform of the base image.
+	Platform string `json:"platform"`
+	// Namespace is the containerd namespace the images are loaded into.
+	Namespace string `json:"namespace"`
+	// Labels are added to the resulting VM image.
+	Labels map[string]string `json:"labels"`
+	// Images are the container images preloaded in the VM image.
+	Images []imageSpec `json:"images"`
+	// Archives are the local image archives imported in the VM image.
+	Archives []archiveSpec `json:"archives"`
+	// DockerImages are the images exported from the host docker daemon and
+	// imported in the VM image.
+	DockerImages []string `json:"dockerImages"`
+	// Remove are the images of the From VM image removed from the VM image.
+	Remove []string `json:"remove"`
+	// Dockerfile is the path of a Dockerfile snippet applied on top of the
+	// base image before the images are loaded.
+	Dockerfile string `json:"dockerfile"`
+	// Context is the build context directory of the Dockerfile snippet.
+	// Defaults to the directory of the Dockerfile.
+	Context string `json:"context"`
+	// Apps are the application containers started at VM boot.
+	Apps []appSpec `json:"apps"`
+}
+
+// imageSpec is a container image to be preloaded in the VM image along with
+// the options used to pull it.
+type imageSpec struct {
+	// Name is the image reference.
+	Name string `json:"name"`
+	// PlainHTTP allows pulling the image from a registry over HTTP.
+	PlainHTTP bool `json:"plainHTTP"`
+	// SkipVerify skips the TLS verification of the registry.
+	SkipVerify bool `json:"skipVerify"`
+}
+
+// loadVMImageSpec reads a VM image spec file and returns the spec with the
+// defaults applied. The relative paths in the spec are relative to the
+// directory of the spec file.
+func loadVMImageSpec(path string) (*vmImageSpec, error) {
+	spec := &vmImageSpec{}
+	if err := readSpecFile(path, spec); err != nil {
+		return nil, err
+	}
+	if spec.Version == "" {
+		return nil, fmt.Errorf("spec file %q has no version, want %q", path, vmImageSpecVersion)
+	}
+	spec.resolvePaths(filepath.Dir(path))
+	spec.setDefaults()
+
+	return spec, nil
+}
+
+// readSpecFile reads a YAML or JSON spec file into spec. Unknown fields in the
+// file are reported as errors. The case of the map keys, like the label keys,
+// is preserved.
+func readSpecFile(path string, spec interface{}) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read spec file %q: %v", path, err)
+	}
+	if err := yaml.UnmarshalStrict(data, spec); err != nil {
+		return fmt.Errorf("failed to parse spec file %q: %v", path, err)
+	}
+	return nil
+}
+
+// resolvePaths makes the relative local paths of the spec relative to dir.
+func (s *vmImageSpec) resolvePaths(dir string) {
+	for i := range s.Archives {
+		s.Archives[i].Path = resolvePath(dir, s.Archives[i].Path)
+	}
+	s.Dockerfile = resolvePath(dir, s.Dockerfile)
+	s.Context = resolvePath(dir, s.Context)
+}
+
+// resolvePath returns a relative path p relative to dir. Empty and absolute
+// paths are returned as is.
+func resolvePath(dir, p string) string {
+	if p == "" || filepath.IsAbs(p) {
+		return p
+	}
+	return filepath.Join(dir, p)
+}
+
+// setDefaults sets the default values of the unset optional fields.
+func (s *vmImageSpec) setDefaults() {
+	if s.Version == "" {
+		s.Version = vmImageSpecVersion
+	}
+	if s.Tag == "" {
+		s.Tag = "latest"
+	}
+	if s.BaseImage == "" && s.From == "" {
+		s.BaseImage = defaultBaseImage
+	}
+	if s.Namespace == "" {
+		s.Namespace = containerdNamespace
+	}
+	if s.Dockerfile != "" && s.Context == "" {
+		s.Context = filepath.Dir(s.Dockerfile)
+	}
+	for i := range s.Apps {
+		s.Apps[i].setDefaults()
+	}
+}
+
+// setImageRef sets the name and tag of the spec from a VM image reference.
+func (s *vmImageSpec) setImageRef(ref string) {
+	s.Name, s.Tag = splitImageRef(ref)
+}
+
+// splitImageRef separates an image reference into the image name and tag. The
+// tag defaults to latest. A registry port is part of the name.
+func splitImageRef(ref string) (string, string) {
+	i := strings.LastIndex(ref, ":")
+	if i < 0 || strings.Contains(ref[i:], "/") {
+		return ref, "latest"
+	}
+	return ref[:i], ref[i+1:]
+}
+
+// imageRef returns the VM image reference in <name>:<tag> format.
+func (s *vmImageSpec) imageRef() string {
+	return fmt.Sprintf("%s:%s", s.Name, s.Tag)
+}
+
+// buildImage returns the image used to create the build container, the From
+// VM image if set, else the base image.
+func (s *vmImageSpec) buildImage() string {
+	if s.From != "" {
+		return s.From
+	}
+	return s.BaseImage
+}
+
+// addImages appends the given image references to the spec images.
+func (s *vmImageSpec) addImages(refs []string) {
+	for _, ref := range refs {
+		s.Images = append(s.Images, imageSpec{Name: ref})
+	}
+}
+
+// addArchives appends the given archive paths to the spec archives.
+func (s *vmImageSpec) addArchives(paths []string) {
+	for _, p := range paths {
+		s.Archives = append(s.Archives, archiveSpec{Path: p})
+	}
+}
+
+// validateRuntime checks that the spec options are supported by the container
+// runtime of the base image.
+func (s *vmImageSpec) validateRuntime(rt containerRuntime) error {
+	if rt.Name() != runtimeDocker {
+		return nil
+	}
+	for i, img := range s.Images {
+		if img.PlainHTTP || img.SkipVerify {
+			return fmt.Errorf("images[%d]: plainHTTP and skipVerify aren't supported by the docker runtime, configure the registry as insecure in the docker daemon of the base image", i)
+		}
+	}
+	return nil
+}
+
+// validate checks if the spec is complete and usable for a build.
+func (s *vmImageSpec) validate() error {
+	if s.Version != vmImageSpecVersion {
+		return fmt.Errorf("unsupported spec version %q, want %q", s.Version, vmImageSpecVersion)
+	}
+	if s.Name == "" {
+		return errors.New("VM image name must be set")
+	}
+	if strings.Contains(s.Tag, ":") || strings.Contains(s.Tag, "/") {
+		return fmt.Errorf("invalid VM image tag %q", s.Tag)
+	}
+	if s.BaseImage == "" && s.From == "" {
+		return errors.New("base image must be set")
+	}
+	if s.BaseImage != "" && s.From != "" {
+		return errors.New("base image and from VM image are mutually exclusive, the from VM image has a base image")
+	}
+	if len(s.Remove) > 0 && s.From == "" {
+		return errors.New("images can only be removed when building from an existing VM image")
+	}
+	if s.Platform != "" {
+		if _, err := normalizePlatform(s.Platform); err != nil {
+			return err
+		}
+	}
+
+	seen := map[string]bool{}
+	for i, img := range s.Images {
+		if img.Name == "" {
+			return fmt.Errorf("images[%d]: image name must be set", i)
+		}
+		if seen[img.Name] {
+			return fmt.Errorf("images[%d]: duplicate image %q", i, img.Name)
+		}
+		seen[img.Name] = true
+	}
+
+	for i, archive := range s.Archives {
+		if archive.Path == "" {
+			return fmt.Errorf("archives[%d]: archive path must be set", i)
+		}
+	}
+
+	for i, img := range s.DockerImages {
+		if img == "" {
+			return fmt.Errorf("dockerImages[%d]: image name must be set", i)
+		}
+	}
+
+	for i, img := range s.Remove {
+		if img == "" {
+			return fmt.Errorf("remove[%d]: image name must be set", i)
+		}
+		if seen[img] {
+			return fmt.Errorf("remove[%d]: image %q is both added and removed", i, img)
+		}
+	}
+
+	if s.Context != "" && s.Dockerfile == "" {
+		return errors.New("build context needs a Dockerfile")
+	}
+
+	apps := map[string]bool{}
+	for i, app := range s.Apps {
+		if err := app.validate(); err != nil {
+			return fmt.Errorf("apps[%d]: %v", i, err)
+		}
+		if apps[app.Name] {
+			return fmt.Errorf("apps[%d]: duplicate app %q", i, app.Name)
+		}
+		apps[app.Name] = true
+	}
+
+	return nil
+}
@@ -0,0 +1,115 @@
+package cmd
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestLoadVMImageSpec(t *testing.T) {
+	dir, err := ioutil.TempDir("", "spec")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name    string
+		spec    string
+		check   func(t *testing.T, spec *vmImageSpec)
+		wantErr bool
+	}{
+		{
+			name: "mixed case label keys",
+			spec: `version: v1alpha1
+name: foo/vm
+labels:
+  MyTeam: A
+  org.opencontainers.image.Source: https://example.com
+`,
+			check: func(t *testing.T, spec *vmImageSpec) {
+				want := map[string]string{"MyTeam": "A", "org.opencontainers.image.Source": "https://example.com"}
+				if !reflect.DeepEqual(spec.Labels, want) {
+					t.Errorf("got labels %v, want %v", spec.Labels, want)
+				}
+			},
+		},
+		{
+			name: "relative paths",
+			spec: `version: v1alpha1
+name: foo/vm
+archives:
+  - path: myapp.tar
+  - path: /abs/oci-layout
+dockerfile: vm.Dockerfile
+context: ./vm
+`,
+			check: func(t *testing.T, spec *vmImageSpec) {
+				wantArchives := []archiveSpec{{Path: filepath.Join(dir, "myapp.tar")}, {Path: "/abs/oci-layout"}}
+				if !reflect.DeepEqual(spec.Archives, wantArchives) {
+					t.Errorf("got archives %+v, want %+v", spec.Archives, wantArchives)
+				}
+				if want := filepath.Join(dir, "vm.Dockerfile"); spec.Dockerfile != want {
+					t.Errorf("got dockerfile %q, want %q", spec.Dockerfile, want)
+				}
+				if want := filepath.Join(dir, "vm"); spec.Context != want {
+					t.Errorf("got context %q, want %q", spec.Context, want)
+				}
+			},
+		},
+		{
+			name: "default context",
+			spec: `version: v1alpha1
+name: foo/vm
+dockerfile: build/vm.Dockerfile
+`,
+			check: func(t *testing.T, spec *vmImageSpec) {
+				if want := filepath.Join(dir, "build"); spec.Context != want {
+					t.Errorf("got context %q, want %q", spec.Context, want)
+				}
+			},
+		},
+		{
+			name: "images",
+			spec: `version: v1alpha1
+name: foo/vm
+images:
+  - name: localhost:5000/myapp:dev
+    plainHTTP: true
+`,
+			check: func(t *testing.T, spec *vmImageSpec) {
+				want := []imageSpec{{Name: "localhost:5000/myapp:dev", PlainHTTP: true}}
+				if !reflect.DeepEqual(spec.Images, want) {
+					t.Errorf("got images %+v, want %+v", spec.Images, want)
+				}
+			},
+		},
+		{
+			name:    "unknown field",
+			spec:    "version: v1alpha1\nname: foo/vm\nimage: foo\n",
+			wantErr: true,
+		},
+		{
+			name:    "no version",
+			spec:    "name: foo/vm\n",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, "build.yaml")
+			if err := ioutil.WriteFile(path, []byte(tt.spec), 0644); err != nil {
+				t.Fatal(err)
+			}
+			spec, err := loadVMImageSpec(path)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr {
+				tt.check(t, spec)
+			}
+		})
+	}
+}
@@ -1,13 +1,14 @@
 package cmd
 
 import (
-	"context"
 	"errors"
 	"fmt"
-	"math/rand"
+	"os"
 	"strings"
+	"syscall"
 	"time"
 
+	reference "github.com/containerd/containerd/reference/docker"
 	docker "github.com/fsouza/go-dockerclient"
 	"github.com/spf13/cobra"
 )
@@ -15,171 +16,548 @@ import (
 var (
 	images    []string
 	baseImage string
+	// specFile is the path of a VM image build spec file.
+	specFile string
+	// archives are the paths of local image archives to be imported.
+	archives []string
+	// dockerImages are the host docker daemon images to be imported.
+	dockerImages []string
+	// registryAuths are the registry credentials passed as
+	// <registry>=<username>:<password>.
+	registryAuths []string
+	// pullParallelism is the maximum number of concurrent image pulls.
+	pullParallelism int
+	// keepBuildContainer disables the removal of the build container.
+	keepBuildContainer bool
+	// vmPlatform is the platform of the VM image.
+	vmPlatform string
+	// vmFrom is an existing VM image to start the build from.
+	vmFrom string
+	// removeImages are the images of the from VM image to be removed.
+	removeImages []string
+	// lockFilePath is the path of the lock file of the image digests.
+	lockFilePath string
+	// lockedBuild enables pulling the images by the digests in the lock file.
+	lockedBuild bool
+	// importVM enables importing the VM image into the ignite image store.
+	importVM bool
+	// pushVM enables pushing the VM image to its registry.
+	pushVM bool
 )
 
 const (
 	buildContainerPrefix = "ignite-cntr-build"
 	ctrPath              = "/usr/bin/ctr"
 	containerdNamespace  = "ignite"
+
+	// runtimeStartRetries is the number of times the container runtime
+	// readiness is checked, every half a second, before giving up.
+	runtimeStartRetries = 60
+
+	// outputTailLines is the number of command output lines reported when a
+	// command fails.
+	outputTailLines = 10
 )
 
 // vmCmd represents the vm command
 var vmCmd = &cobra.Command{
-	Use:   "vm <vm-image-name>",
+	Use:   "vm [<vm-image-name>]",
 	Short: "Create VM application image.",
 	Long: `Create VM application image with preloaded container images. These
-images can be quickly run when the VM starts.`,
+images can be quickly run when the VM starts.
+
+The build can also be described in a spec file passed with --file. Flags and
+arguments passed along with a spec file override the values in the spec.`,
 	Args: func(cmd *cobra.Command, args []string) error {
+		if specFile != "" {
+			if len(args) > 1 {
+				return errors.New("require at most one VM image name argument with a spec file")
+			}
+			return nil
+		}
 		if len(args) != 1 {
 			return errors.New("require one VM image name argument")
 		}
 		return nil
 	},
 	Run: func(cmd *cobra.Command, args []string) {
-		vmImage := args[0]
-		if err := runVMImageBuild(vmImage, baseImage, images); err != nil {
+		spec, err := vmImageSpecFromFlags(cmd, args)
+		if err != nil {
+			fmt.Printf("error: %v\n", err)
+			return
+		}
+		if err := runVMImageBuild(spec); err != nil {
 			fmt.Printf("error: %v\n", err)
 		}
 	},
 }
 
-func runVMImageBuild(vmImage string, baseImage string, containerImages []string) error {
-	var vmImageName, vmImageTag string
+// vmImageSpecFromFlags constructs a VM image spec from the spec file, if any,
+// and the command flags and arguments.
+func vmImageSpecFromFlags(cmd *cobra.Command, args []string) (*vmImageSpec, error) {
+	spec := &vmImageSpec{}
+	if specFile != "" {
+		var err error
+		if spec, err = loadVMImageSpec(specFile); err != nil {
+			return nil, err
+		}
+	}
 
-	// Separate image name and tag.
-	vmImg := strings.SplitN(vmImage, ":", 2)
-	vmImageName = vmImg[0]
-	if len(vmImg) < 2 {
-		vmImageTag = "latest"
+	if len(args) == 1 {
+		spec.setImageRef(args[0])
+	}
+	if vmFrom != "" {
+		// The from VM image replaces the base image of the spec file.
+		spec.From = vmFrom
+		spec.BaseImage = ""
+	}
+	if cmd.Flags().Changed("baseImage") || (spec.BaseImage == "" && spec.From == "") {
+		spec.BaseImage = baseImage
+	}
+	if vmPlatform != "" {
+		spec.Platform = vmPlatform
+	}
+	spec.addImages(images)
+	spec.addArchives(archives)
+	spec.DockerImages = append(spec.DockerImages, dockerImages...)
+	spec.Remove = append(spec.Remove, removeImages...)
+	if vmDockerfile != "" {
+		// The context of the spec Dockerfile doesn't apply to this one.
+		spec.Dockerfile = vmDockerfile
+		spec.Context = ""
+	}
+	if vmDockerfileContext != "" {
+		spec.Context = vmDockerfileContext
+	}
+	if appImage == "" {
+		for _, name := range []string{"app-name", "app-cmd", "app-arg", "app-env", "app-net-host", "app-mount"} {
+			if cmd.Flags().Changed(name) {
+				return nil, fmt.Errorf("--%s needs --app", name)
+			}
+		}
 	} else {
-		vmImageTag = vmImg[1]
+		spec.Apps = append(spec.Apps, appSpec{
+			Name:    appName,
+			Image:   appImage,
+			Cmd:     vmAppCmd,
+			Args:    vmAppArgs,
+			Env:     vmAppEnv,
+			NetHost: vmAppNetHost,
+			Mounts:  vmAppMounts,
+		})
 	}
+	spec.setDefaults()
+
+	if err := spec.validate(); err != nil {
+		return nil, fmt.Errorf("invalid VM image spec: %v", err)
+	}
+	return spec, nil
+}
 
-	// Initialize a docker client.
-	client, err := docker.NewClientFromEnv()
+func runVMImageBuild(spec *vmImageSpec) (retErr error) {
+	// Fail early instead of after the build.
+	if importVM && syscall.Getuid() != 0 {
+		return fmt.Errorf("importing the VM image into ignite needs to be run as root")
+	}
+	if dropBlobs && !optimizeVM {
+		return fmt.Errorf("--drop-blobs needs --optimize")
+	}
+	// ignite's containerd runtime only finds the images of its namespace.
+	if importVM && builderName == builderContainerd && containerdBuildNamespace != defaultContainerdBuildNamespace {
+		return fmt.Errorf("importing the VM image into ignite needs the containerd namespace %q", defaultContainerdBuildNamespace)
+	}
+
+	authStore, err := newRegistryAuthStore(registryAuths)
 	if err != nil {
 		return err
 	}
 
-	ctx := context.Background()
-
-	rand.Seed(time.Now().UnixNano())
+	var dockerfileSteps []dockerfileStep
+	if spec.Dockerfile != "" {
+		if dockerfileSteps, err = readDockerfileSnippet(spec.Dockerfile); err != nil {
+			return err
+		}
+	}
 
-	// Create a build container using the base image with random name. The
-	// container needs to stay around, run infinite sleep.
-	buildContainerName := fmt.Sprintf("%s-%d", buildContainerPrefix, rand.Int())
-	containerOpts := docker.CreateContainerOptions{
-		Name: buildContainerName,
-		Config: &docker.Config{
-			Image: baseImage,
-			Cmd:   []string{"sleep", "infinity"},
-		},
-		HostConfig: &docker.HostConfig{
-			Privileged: true,
-		},
-		Context: ctx,
+	// Pull the locked digests of the images in a locked build.
+	var digests map[string]string
+	if lockedBuild {
+		lock, err := readLockFile(lockFilePath)
+		if err != nil {
+			return err
+		}
+		if digests, err = lock.digests(spec.Images); err != nil {
+			return err
+		}
 	}
-	container, err := client.CreateContainer(containerOpts)
+
+	b, err := newImageBuilder(builderName)
 	if err != nil {
-		return fmt.Errorf("failed to create build container: %v", err)
-	}
-	if err := client.StartContainerWithContext(container.ID, nil, ctx); err != nil {
-		return fmt.Errorf("failed to start build container: %v", err)
+		return err
 	}
-	fmt.Printf("Started build container %s\n", container.Name)
+	defer b.Close()
 
-	// Start containerd inside the build container.
-	fmt.Println("Starting containerd in the build container...")
-	execOpts := docker.CreateExecOptions{
-		Privileged: true,
-		Container:  container.ID,
-		Cmd:        []string{"/usr/bin/containerd", "&"},
+	// Use the base image for the VM image platform.
+	buildImage := spec.buildImage()
+	baseImg, platform, err := ensureBaseImage(b, buildImage, spec.Platform)
+	if err != nil {
+		return err
 	}
-	cntrExec, err := client.CreateExec(execOpts)
+	fmt.Printf("Building VM image for platform %s\n", platform)
+
+	// Load the images with the container runtime installed in the base image.
+	baseLabels := baseImg.Labels
+	rt, err := runtimeFromLabels(baseLabels)
 	if err != nil {
+		return fmt.Errorf("invalid base image %q: %v", buildImage, err)
+	}
+	if err := spec.validateRuntime(rt); err != nil {
 		return err
 	}
-	startExecOpts := docker.StartExecOptions{
-		Detach: true,
+
+	// The VM image inherits the base image of the from VM image.
+	manifest := &vmImageManifest{
+		BaseImage:   spec.BaseImage,
+		BaseImageID: baseImg.ID,
+		Platform:    platform,
+		Runtime:     rt.Name(),
+		Namespace:   spec.Namespace,
 	}
-	execCloser, err := client.StartExecNonBlocking(cntrExec.ID, startExecOpts)
-	if execCloser != nil {
-		defer execCloser.Close()
+	if spec.From != "" {
+		fromManifest, err := manifestFromLabels(baseLabels)
+		if err != nil {
+			return fmt.Errorf("invalid manifest of VM image %q: %v", spec.From, err)
+		}
+		if fromManifest == nil {
+			return fmt.Errorf("image %q has no ignite-cntr manifest, not a VM image built by ignite-cntr", spec.From)
+		}
+		if fromManifest.Namespace != spec.Namespace {
+			return fmt.Errorf("VM image %q has images in namespace %q, want %q; set the namespace in the spec", spec.From, fromManifest.Namespace, spec.Namespace)
+		}
+		manifest.BaseImage = fromManifest.BaseImage
+		manifest.BaseImageID = fromManifest.BaseImageID
 	}
 
-	// Create ignite containerd namespace.
-	fmt.Printf("Creating containerd namespace: %s...\n", containerdNamespace)
-	createNSExecOpts := execOpts
-	createNSExecOpts.Cmd = []string{ctrPath, "namespace", "create", containerdNamespace}
-	createNSExec, err := client.CreateExec(createNSExecOpts)
+	// Create a build container using the base image with random name.
+	sb, err := b.CreateSandbox(newBuildContainerName(), buildImage, platform)
 	if err != nil {
 		return err
 	}
-	err = client.StartExec(createNSExec.ID, startExecOpts)
-	if err != nil {
+
+	// Remove the build container when the build returns or is interrupted.
+	cleanup := newBuildContainerCleanup(sb, keepBuildContainer)
+	defer func() {
+		if err := cleanup.run(); err != nil {
+			if retErr == nil {
+				retErr = err
+				return
+			}
+			fmt.Printf("error: %v\n", err)
+		}
+	}()
+	stopInterruptHandler := handleInterrupt(cleanup)
+	defer stopInterruptHandler()
+
+	fmt.Printf("Started build container %s\n", sb.Name())
+
+	// Extend the base image before the runtime loads the images.
+	var dockerfileEnv []string
+	if len(dockerfileSteps) > 0 {
+		fmt.Printf("Applying Dockerfile %s...\n", spec.Dockerfile)
+		if dockerfileEnv, err = applyDockerfileSnippet(sb, dockerfileSteps, spec.Context, os.Stdout); err != nil {
+			return fmt.Errorf("failed to apply Dockerfile %q: %v", spec.Dockerfile, err)
+		}
+	}
+
+	// Start the container runtime inside the build container.
+	fmt.Printf("Starting %s in the build container...\n", rt.Name())
+	if err := sb.Start(rt.DaemonCmd()); err != nil {
+		return fmt.Errorf("failed to start %s: %v", rt.Name(), err)
+	}
+	if err := waitForRuntime(sb, rt); err != nil {
 		return err
 	}
 
+	// Create the namespace of the images in the runtime. The from VM image
+	// already has it.
+	setupCmd := rt.SetupCmd(spec.Namespace)
+	if setupCmd != nil && spec.From == "" {
+		fmt.Printf("Creating %s namespace: %s...\n", rt.Name(), spec.Namespace)
+		if _, err := runExec(sb, setupCmd); err != nil {
+			return fmt.Errorf("failed to create %s namespace %q: %v", rt.Name(), spec.Namespace, err)
+		}
+	}
+
+	// Only pull the images missing in the from VM image.
+	pullSpecs := spec.Images
+	if spec.From != "" {
+		if pullSpecs, err = updateFromImages(sb, rt, spec); err != nil {
+			return err
+		}
+	}
+
+	// Images expected to be present in the build container before commit.
+	var wantImages []string
+
 	// Pull the application images.
-	for _, containerImage := range containerImages {
-		pullExecOpts := execOpts
-		pullExecOpts.Cmd = []string{
-			ctrPath, fmt.Sprintf("--namespace=%s", containerdNamespace),
-			"image", "pull", containerImage,
+	pullResults, err := pullImages(sb, rt, spec, pullSpecs, digests, authStore, pullParallelism)
+	if err != nil {
+		return err
+	}
+	for _, containerImage := range spec.Images {
+		wantImages = append(wantImages, containerImage.Name)
+	}
+
+	// Import the local image archives.
+	for i, archive := range spec.Archives {
+		if err := importArchive(sb, rt, spec.Namespace, i, archive); err != nil {
+			return err
 		}
-		pullExec, err := client.CreateExec(pullExecOpts)
-		if err != nil {
+	}
+	if len(spec.Archives) > 0 {
+		if _, err := runExec(sb, cleanupArchivesCmd()); err != nil {
+			return fmt.Errorf("failed to remove the archives from the build container: %v", err)
+		}
+	}
+
+	// Import the images from the host docker daemon, the only docker
+	// dependency of the containerd builder.
+	var dockerClient *docker.Client
+	if len(spec.DockerImages) > 0 {
+		if dockerClient, err = docker.NewClientFromEnv(); err != nil {
 			return err
 		}
-		err = client.StartExec(pullExec.ID, startExecOpts)
+	}
+	for _, dockerImage := range spec.DockerImages {
+		ref, err := importDockerImage(dockerClient, sb, rt, spec.Namespace, dockerImage)
 		if err != nil {
 			return err
 		}
+		wantImages = append(wantImages, ref)
+	}
 
-		fmt.Printf("Waiting for %s image pull to complete", containerImage)
-		for {
-			inspectRes, err := client.InspectExec(pullExec.ID)
-			if err != nil {
-				return nil
-			}
+	// Verify that all the images are present before creating the VM image.
+	rtImages, err := listImages(sb, rt, spec.Namespace)
+	if err != nil {
+		return err
+	}
+	if err := verifyImages(rtImages, wantImages); err != nil {
+		return err
+	}
+	if digests != nil {
+		if err := verifyLockedDigests(digests, rtImages); err != nil {
+			return err
+		}
+	}
+	printPullSummary(pullResults, imageSizes(rtImages))
 
-			if !inspectRes.Running {
-				break
-			}
-			fmt.Printf(".")
-			time.Sleep(3 * time.Second)
+	// Lock the digests the images resolved to.
+	var lock *lockFile
+	if !lockedBuild && len(spec.Images) > 0 {
+		if lock, err = newLockFile(spec.Images, rtImages); err != nil {
+			return err
+		}
+	}
+
+	// Record the contents of the VM image in the image labels.
+	manifest.Images = newManifestImages(rtImages)
+	labels, err := vmImageLabels(spec, manifest)
+	if err != nil {
+		return err
+	}
+
+	if len(spec.Apps) > 0 {
+		if err := installApps(sb, rt, spec.Namespace, spec.Apps, rtImages); err != nil {
+			return err
+		}
+	}
+
+	if optimizeVM {
+		if err := optimizeSandbox(sb, rt, spec.Namespace, dropBlobs); err != nil {
+			return err
 		}
-		// Newline.
-		fmt.Println()
 	}
 
 	// Commit the container to create an image.
-	commitOpts := docker.CommitContainerOptions{
-		Container:  container.ID,
-		Repository: vmImageName,
-		Tag:        vmImageTag,
-		Context:    ctx,
+	commitOpts := commitOptions{
+		Ref:    spec.imageRef(),
+		Labels: labels,
+		Squash: optimizeVM,
+		Env:    dockerfileEnv,
 	}
-	finalImg, err := client.CommitContainer(commitOpts)
+	imageID, err := sb.Commit(commitOpts)
 	if err != nil {
 		return err
 	}
 
-	fmt.Printf("\nCreated VM application image: %s:%s (%s)\n", vmImageName, vmImageTag, finalImg.ID)
+	fmt.Printf("\nCreated VM application image: %s (%s)\n", spec.imageRef(), imageID)
 
-	// Delete the build container.
-	removeContainerOpts := docker.RemoveContainerOptions{
-		ID:      container.ID,
-		Force:   true,
-		Context: ctx,
+	if lock != nil {
+		if err := lock.write(lockFilePath); err != nil {
+			return err
+		}
+		fmt.Printf("Wrote image digests to %s\n", lockFilePath)
 	}
-	if err := client.RemoveContainer(removeContainerOpts); err != nil {
-		return err
+
+	if pushVM {
+		if _, err := pushImage(b, authStore, spec.imageRef()); err != nil {
+			return err
+		}
+	}
+
+	if importVM {
+		fmt.Println("Importing VM image into ignite...")
+		igniteImg, err := importVMImage(spec.imageRef(), imageID, b.Name())
+		if err != nil {
+			return fmt.Errorf("failed to import VM image into ignite: %v", err)
+		}
+		fmt.Printf("Imported ignite image: %s (UID %s, size %s)\n", igniteImg.Name, igniteImg.GetUID(), igniteImg.Status.OCISource.Size)
 	}
 
 	return nil
 }
 
+// vmImageLabels returns the labels of the VM image, the spec labels along with
+// the manifest labels added by ignite-cntr.
+func vmImageLabels(spec *vmImageSpec, manifest *vmImageManifest) (map[string]string, error) {
+	manifestLabels, err := manifest.labels()
+	if err != nil {
+		return nil, fmt.Errorf("failed to create the VM image manifest: %v", err)
+	}
+
+	labels := map[string]string{}
+	for k, v := range spec.Labels {
+		labels[k] = v
+	}
+	for k, v := range manifestLabels {
+		labels[k] = v
+	}
+	return labels, nil
+}
+
+// outputTail returns the last few lines of a command output, without the
+// terminal control sequences. ctr progress output repeats the whole progress
+// on every update, the error is at the end of the output.
+func outputTail(output string) string {
+	output = ansiEscapeRegexp.ReplaceAllString(output, "")
+	lines := strings.FieldsFunc(output, func(r rune) bool {
+		return r == '\n' || r == '\r'
+	})
+
+	var tail []string
+	for i := len(lines) - 1; i >= 0 && len(tail) < outputTailLines; i-- {
+		if line := strings.TrimSpace(lines[i]); line != "" {
+			tail = append([]string{line}, tail...)
+		}
+	}
+	return strings.Join(tail, "\n")
+}
+
+// withProgressDots runs fn, printing a progress dot every few seconds until
+// fn returns.
+func withProgressDots(fn func() error) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+
+	ticker := time.NewTicker(3 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-ticker.C:
+			fmt.Printf(".")
+		}
+	}
+}
+
+// waitForRuntime waits for the container runtime in the build container to be
+// ready to accept requests.
+func waitForRuntime(sb buildSandbox, rt containerRuntime) error {
+	var err error
+	for i := 0; i < runtimeStartRetries; i++ {
+		if _, err = runExec(sb, rt.VersionCmd()); err == nil {
+			return nil
+		}
+		time.Sleep(500 * time.Millisecond)
+	}
+	return fmt.Errorf("%s in the build container is not ready: %v", rt.Name(), err)
+}
+
+// listImages lists the images in the container runtime of the build container,
+// keyed by normalized image reference.
+func listImages(sb buildSandbox, rt containerRuntime, namespace string) (map[string]runtimeImage, error) {
+	out, err := runExec(sb, rt.ListImagesCmd(namespace))
+	if err != nil {
+		return nil, fmt.Errorf("failed to list images: %v", err)
+	}
+	return rt.ParseImages(out), nil
+}
+
+// verifyImages checks that all the wanted images exist in the listed images.
+func verifyImages(rtImages map[string]runtimeImage, wantImages []string) error {
+	var missing []string
+	for _, img := range wantImages {
+		if _, ok := findImage(rtImages, img); !ok {
+			missing = append(missing, img)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("images not found in the build container: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
+
+// findImage returns the listed image of an image reference. A reference with
+// a digest also matches an image of the same repository with that digest,
+// docker lists the images pulled by digest under their tags.
+func findImage(rtImages map[string]runtimeImage, ref string) (runtimeImage, bool) {
+	if img, ok := rtImages[normalizeImageRef(ref)]; ok {
+		return img, true
+	}
+	named, err := reference.ParseDockerRef(ref)
+	if err != nil {
+		return runtimeImage{}, false
+	}
+	digested, ok := named.(reference.Digested)
+	if !ok {
+		return runtimeImage{}, false
+	}
+	for _, img := range rtImages {
+		imgNamed, err := reference.ParseDockerRef(img.Ref)
+		if err != nil {
+			continue
+		}
+		if imgNamed.Name() == named.Name() && img.Digest == digested.Digest().String() {
+			return img, true
+		}
+	}
+	return runtimeImage{}, false
+}
+
+// imageSizes returns the sizes of the listed images keyed by normalized image
+// reference.
+func imageSizes(rtImages map[string]runtimeImage) map[string]string {
+	sizes := map[string]string{}
+	for ref, img := range rtImages {
+		sizes[ref] = img.Size
+	}
+	return sizes
+}
+
+// normalizeImageRef returns the fully qualified form of an image reference, as
+// stored by containerd. Invalid references are returned as is.
+func normalizeImageRef(ref string) string {
+	named, err := reference.ParseDockerRef(ref)
+	if err != nil {
+		return ref
+	}
+	return named.String()
+}
+
 func init() {
 	imageCmd.AddCommand(vmCmd)
 
@@ -195,4 +573,28 @@ func init() {
 
 	vmCmd.Flags().StringArrayVarP(&images, "image", "i", images, "Set an image to be loaded")
 	vmCmd.Flags().StringVarP(&baseImage, "baseImage", "b", defaultBaseImage, "Base image of the VM image build container")
+	vmCmd.Flags().StringVarP(&specFile, "file", "f", "", "Path of a VM image build spec file")
+	vmCmd.Flags().StringArrayVar(&dockerImages, "from-docker", dockerImages, "Set an image in the host docker to be loaded")
+	vmCmd.Flags().IntVar(&pullParallelism, "parallel", defaultPullParallelism, "Maximum number of images pulled concurrently")
+	vmCmd.Flags().StringVar(&vmPlatform, "platform", "", "Platform of the VM image, <os>/<arch>[/<variant>] (default is the base image platform)")
+	vmCmd.Flags().BoolVar(&keepBuildContainer, "keep-build-container", false, "Keep the build container after the build, for debugging")
+	vmCmd.Flags().StringArrayVar(&registryAuths, "registry-auth", registryAuths, "Set registry credentials for pulling images (<registry>=<username>:<password>)")
+	vmCmd.Flags().StringArrayVar(&archives, "archive", archives, "Set a local docker-archive, OCI archive or OCI layout directory to be imported")
+	vmCmd.Flags().StringVar(&vmFrom, "from", "", "Existing VM image to start the build from, only the missing images are pulled")
+	vmCmd.Flags().StringArrayVar(&removeImages, "remove", removeImages, "Set an image of the --from VM image to be removed")
+	vmCmd.Flags().StringVar(&lockFilePath, "lock-file", defaultLockFile, "Path of the lock file of the image digests")
+	vmCmd.Flags().BoolVar(&importVM, "import", false, "Import the VM image into the ignite image store after the build")
+	vmCmd.Flags().BoolVar(&pushVM, "push", false, "Push the VM image to its registry after the build, with the --registry-auth credentials")
+	vmCmd.Flags().BoolVar(&optimizeVM, "optimize", false, "Shrink the VM image with the runtime garbage collection, the removal of caches, temporary files and logs, and a squashed single layer")
+	vmCmd.Flags().BoolVar(&dropBlobs, "drop-blobs", false, "Remove the compressed layer blobs of the unpacked images, with --optimize")
+	vmCmd.Flags().StringVar(&appImage, "app", "", "Image of an app container started at VM boot, the image must be loaded")
+	vmCmd.Flags().StringVar(&appName, "app-name", "", "Name of the --app container (default is the image name)")
+	vmCmd.Flags().StringVar(&vmAppCmd, "app-cmd", "", "Command of the --app container")
+	vmCmd.Flags().StringArrayVar(&vmAppArgs, "app-arg", vmAppArgs, "Arguments to the command of the --app container")
+	vmCmd.Flags().StringArrayVar(&vmAppEnv, "app-env", vmAppEnv, "Set environment variables for the --app container (SOME_VAR=someval)")
+	vmCmd.Flags().BoolVar(&vmAppNetHost, "app-net-host", false, "Enable host networking for the --app container")
+	vmCmd.Flags().StringArrayVar(&vmAppMounts, "app-mount", vmAppMounts, "Set a bind mount of a VM path in the --app container (<vm-path>:<container-path>[:ro|rw])")
+	vmCmd.Flags().StringVar(&vmDockerfile, "dockerfile", "", "Path of a Dockerfile snippet with RUN, COPY and ENV steps applied on top of the base image")
+	vmCmd.Flags().StringVar(&vmDockerfileContext, "context", "", "Build context directory of the --dockerfile COPY sources (default is the Dockerfile directory)")
+	vmCmd.Flags().BoolVar(&lockedBuild, "locked", false, "Pull the images by the digests in the lock file, fail if an image is not locked")
 }
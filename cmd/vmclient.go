@@ -0,0 +1,390 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/containerd/containerd"
+	"github.com/containerd/containerd/cio"
+	"github.com/containerd/containerd/errdefs"
+	"github.com/containerd/containerd/namespaces"
+	"github.com/containerd/containerd/oci"
+	docker "github.com/fsouza/go-dockerclient"
+	rspecs "github.com/opencontainers/runtime-spec/specs-go"
+	gossh "golang.org/x/crypto/ssh"
+	"google.golang.org/grpc"
+)
+
+const (
+	// vmContainerdSocket is the containerd socket in the VM.
+	vmContainerdSocket = "/run/containerd/containerd.sock"
+	// vmDockerSocket is the docker socket in the VM.
+	vmDockerSocket = "/var/run/docker.sock"
+
+	// vmRuntimeDialTimeout is the timeout of the connection to the runtime
+	// socket of a VM.
+	vmRuntimeDialTimeout = 10 * time.Second
+)
+
+// vmRuntimeClient runs application containers in a VM through the API of the
+// VM container runtime. The runtime socket of the VM is forwarded over SSH.
+type vmRuntimeClient interface {
+	// RunApp creates and starts an application container, pulling its image
+	// if it isn't in the VM.
+	RunApp(app appContainer) error
+	// Exists returns true if a container with the given name exists.
+	Exists(name string) (bool, error)
+	// RemoveApp stops and removes a container, its task and its network.
+	RemoveApp(name string) error
+	// Close closes the connection to the runtime.
+	Close() error
+}
+
+// newVMRuntimeClient returns the client of the runtime of the VM with the given
+// ID, connected to the runtime socket through the SSH connection to the VM.
+// The namespace is the containerd namespace of the containers.
+func newVMRuntimeClient(rt containerRuntime, sshClient *gossh.Client, vmID, namespace string) (vmRuntimeClient, error) {
+	switch rt.Name() {
+	case runtimeContainerd:
+		return newVMContainerdClient(sshClient, vmID, namespace)
+	case runtimeDocker:
+		client, err := docker.NewClient("unix://" + vmDockerSocket)
+		if err != nil {
+			return nil, err
+		}
+		// The docker client dials the socket with its Dialer.
+		client.Dialer = sshClient
+		return &vmDockerClient{client: client}, nil
+	default:
+		return nil, fmt.Errorf("no client for the %s runtime", rt.Name())
+	}
+}
+
+// vmContainerdClient runs containers with the containerd of a VM. The
+// containers without host networking are connected to the VM network with CNI.
+type vmContainerdClient struct {
+	client  *containerd.Client
+	network *vmNetwork
+	ctx     context.Context
+}
+
+// newVMContainerdClient connects to the containerd socket of a VM.
+func newVMContainerdClient(sshClient *gossh.Client, vmID, namespace string) (*vmContainerdClient, error) {
+	network, err := newVMNetwork(sshClient, vmID)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := func(ctx context.Context, addr string) (net.Conn, error) {
+		return sshClient.Dial("unix", addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), vmRuntimeDialTimeout)
+	defer cancel()
+	conn, err := grpc.DialContext(ctx, vmContainerdSocket,
+		grpc.WithInsecure(),
+		grpc.WithBlock(),
+		grpc.WithContextDialer(dialer),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to containerd in the VM: %v", err)
+	}
+
+	client, err := containerd.NewWithConn(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("failed to create containerd client: %v", err)
+	}
+	return &vmContainerdClient{
+		client:  client,
+		network: network,
+		ctx:     namespaces.WithNamespace(context.Background(), namespace),
+	}, nil
+}
+
+// RunApp creates the container with the image config and the app options, like
+// ctr container create, and starts its task with no IO, like ctr task start
+// -d. Without host networking, the network namespace of the task is connected
+// to the VM network before the start, like ctr run --cni.
+func (c *vmContainerdClient) RunApp(app appContainer) error {
+	image, err := c.ensureImage(app.Image)
+	if err != nil {
+		return err
+	}
+
+	specOpts := []oci.SpecOpts{oci.WithImageConfig(image)}
+	if app.Cmd != "" {
+		specOpts = append(specOpts, oci.WithProcessArgs(append([]string{app.Cmd}, app.Args...)...))
+	}
+	if len(app.Env) > 0 {
+		specOpts = append(specOpts, oci.WithEnv(app.Env))
+	}
+	if app.NetHost {
+		specOpts = append(specOpts,
+			oci.WithHostNamespace(rspecs.NetworkNamespace),
+			oci.WithHostHostsFile,
+			oci.WithHostResolvconf,
+		)
+	} else {
+		specOpts = append(specOpts, oci.WithHostResolvconf)
+	}
+	if len(app.Mounts) > 0 {
+		specOpts = append(specOpts, oci.WithMounts(ociBindMounts(app.Mounts)))
+	}
+
+	// Without the CNI plugins, the container only has a loopback, like the
+	// containers run before the CNI support.
+	withNetwork := false
+	if !app.NetHost {
+		if withNetwork, err = c.network.Available(); err != nil {
+			return err
+		}
+		if !withNetwork {
+			if len(app.Ports) > 0 {
+				return fmt.Errorf("can't publish the ports of container %s, the VM has no CNI plugins in %s, rebuild the VM image from a newer base image or use --net-host", app.Name, vmCNIBinDir)
+			}
+			fmt.Printf("Warning: the VM has no CNI plugins in %s, running container %s without network, use --net-host for host networking\n", vmCNIBinDir, app.Name)
+		}
+	}
+
+	labels := map[string]string{}
+	if withNetwork {
+		// Tells RemoveApp to remove the container and its ports from the
+		// network.
+		labels[networkLabel] = vmNetworkName
+		if labels[portsLabel], err = portsLabelValue(app.Ports); err != nil {
+			return err
+		}
+	}
+	container, err := c.client.NewContainer(c.ctx, app.Name,
+		containerd.WithImage(image),
+		containerd.WithNewSnapshot(app.Name+"-snapshot", image),
+		containerd.WithNewSpec(specOpts...),
+		containerd.WithContainerLabels(labels),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to create container %s: %v", app.Name, err)
+	}
+
+	task, err := container.NewTask(c.ctx, cio.NullIO)
+	if err != nil {
+		container.Delete(c.ctx, containerd.WithSnapshotCleanup)
+		return fmt.Errorf("failed to create the task of container %s: %v", app.Name, err)
+	}
+	if withNetwork {
+		ip, err := c.network.Setup(c.ctx, app.Name, task.Pid(), app.Ports)
+		if err != nil {
+			c.network.Remove(c.ctx, app.Name, task.Pid(), app.Ports)
+			task.Delete(c.ctx)
+			container.Delete(c.ctx, containerd.WithSnapshotCleanup)
+			return err
+		}
+		fmt.Printf("Container %s IP: %s\n", app.Name, ip)
+	}
+	if err := task.Start(c.ctx); err != nil {
+		if withNetwork {
+			c.network.Remove(c.ctx, app.Name, task.Pid(), app.Ports)
+		}
+		task.Delete(c.ctx)
+		container.Delete(c.ctx, containerd.WithSnapshotCleanup)
+		return fmt.Errorf("failed to start container %s: %v", app.Name, err)
+	}
+	return nil
+}
+
+// Exists returns true if the container exists.
+func (c *vmContainerdClient) Exists(name string) (bool, error) {
+	_, err := c.client.LoadContainer(c.ctx, name)
+	if errdefs.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get container %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// RemoveApp removes the container from the network, kills and deletes its
+// task, and deletes the container and its snapshot, like ctr task rm --force
+// and ctr container rm.
+func (c *vmContainerdClient) RemoveApp(name string) error {
+	container, err := c.client.LoadContainer(c.ctx, name)
+	if err != nil {
+		return fmt.Errorf("failed to get container %s: %v", name, err)
+	}
+	labels, err := container.Labels(c.ctx)
+	if err != nil {
+		return fmt.Errorf("failed to get the labels of container %s: %v", name, err)
+	}
+	// The host networking containers must not be removed from the network,
+	// their network namespace is the VM's.
+	inNetwork := labels[networkLabel] == vmNetworkName
+	ports, err := portsFromLabels(labels)
+	if err != nil {
+		return fmt.Errorf("failed to get the ports of container %s: %v", name, err)
+	}
+
+	// The task is gone if the container was stopped, the IP is still
+	// released.
+	var pid uint32
+	task, err := container.Task(c.ctx, nil)
+	if err != nil && !errdefs.IsNotFound(err) {
+		return fmt.Errorf("failed to get the task of container %s: %v", name, err)
+	}
+	if task != nil {
+		pid = task.Pid()
+	}
+	if inNetwork {
+		if err := c.network.Remove(c.ctx, name, pid, ports); err != nil {
+			return err
+		}
+	}
+	if task != nil {
+		if _, err := task.Delete(c.ctx, containerd.WithProcessKill); err != nil && !errdefs.IsNotFound(err) {
+			return fmt.Errorf("failed to delete the task of container %s: %v", name, err)
+		}
+	}
+
+	if err := container.Delete(c.ctx, containerd.WithSnapshotCleanup); err != nil {
+		return fmt.Errorf("failed to delete container %s: %v", name, err)
+	}
+	return nil
+}
+
+// ensureImage returns an unpacked image of containerd, pulling it if needed.
+func (c *vmContainerdClient) ensureImage(ref string) (containerd.Image, error) {
+	ref = normalizeImageRef(ref)
+	image, err := c.client.GetImage(c.ctx, ref)
+	if errdefs.IsNotFound(err) {
+		fmt.Printf("Pulling image %s...\n", ref)
+		image, err = c.client.Pull(c.ctx, ref, containerd.WithPullUnpack)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pull image %q: %v", ref, err)
+		}
+		return image, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to get image %q: %v", ref, err)
+	}
+
+	unpacked, err := image.IsUnpacked(c.ctx, containerd.DefaultSnapshotter)
+	if err != nil {
+		return nil, err
+	}
+	if !unpacked {
+		if err := image.Unpack(c.ctx, containerd.DefaultSnapshotter); err != nil {
+			return nil, fmt.Errorf("failed to unpack image %q: %v", ref, err)
+		}
+	}
+	return image, nil
+}
+
+// Close closes the connection to containerd.
+func (c *vmContainerdClient) Close() error {
+	return c.client.Close()
+}
+
+// ociBindMounts returns the OCI mounts of the bind mounts.
+func ociBindMounts(mounts []appMount) []rspecs.Mount {
+	var ociMounts []rspecs.Mount
+	for _, m := range mounts {
+		mode := "rw"
+		if m.ReadOnly {
+			mode = "ro"
+		}
+		ociMounts = append(ociMounts, rspecs.Mount{
+			Type:        "bind",
+			Source:      m.Source,
+			Destination: m.Destination,
+			Options:     []string{"rbind", mode},
+		})
+	}
+	return ociMounts
+}
+
+// vmDockerClient runs containers with the docker daemon of a VM.
+type vmDockerClient struct {
+	client *docker.Client
+}
+
+// RunApp creates and starts a container like docker run -d.
+func (c *vmDockerClient) RunApp(app appContainer) error {
+	if _, err := c.client.InspectImage(app.Image); err == docker.ErrNoSuchImage {
+		fmt.Printf("Pulling image %s...\n", app.Image)
+		repo, tag := docker.ParseRepositoryTag(app.Image)
+		pullOpts := docker.PullImageOptions{Repository: repo, Tag: tag}
+		if err := c.client.PullImage(pullOpts, docker.AuthConfiguration{}); err != nil {
+			return fmt.Errorf("failed to pull image %q: %v", app.Image, err)
+		}
+	}
+
+	config := &docker.Config{
+		Image:        app.Image,
+		Env:          app.Env,
+		ExposedPorts: map[docker.Port]struct{}{},
+	}
+	if app.Cmd != "" {
+		config.Cmd = append([]string{app.Cmd}, app.Args...)
+	}
+	// Without host networking, the container is in the docker bridge network
+	// of the VM, and the ports are published on the VM by docker.
+	hostConfig := &docker.HostConfig{PortBindings: map[docker.Port][]docker.PortBinding{}}
+	if app.NetHost {
+		hostConfig.NetworkMode = "host"
+	}
+	for _, p := range app.Ports {
+		port := docker.Port(fmt.Sprintf("%d/%s", p.ContainerPort, p.Protocol))
+		config.ExposedPorts[port] = struct{}{}
+		hostConfig.PortBindings[port] = append(hostConfig.PortBindings[port], docker.PortBinding{HostPort: strconv.Itoa(int(p.VMPort))})
+	}
+	for _, m := range app.Mounts {
+		hostConfig.Mounts = append(hostConfig.Mounts, docker.HostMount{
+			Type:     "bind",
+			Source:   m.Source,
+			Target:   m.Destination,
+			ReadOnly: m.ReadOnly,
+		})
+	}
+
+	createOpts := docker.CreateContainerOptions{
+		Name:       app.Name,
+		Config:     config,
+		HostConfig: hostConfig,
+	}
+	container, err := c.client.CreateContainer(createOpts)
+	if err != nil {
+		return fmt.Errorf("failed to create container %s: %v", app.Name, err)
+	}
+	if err := c.client.StartContainer(container.ID, nil); err != nil {
+		c.client.RemoveContainer(docker.RemoveContainerOptions{ID: container.ID, Force: true})
+		return fmt.Errorf("failed to start container %s: %v", app.Name, err)
+	}
+	return nil
+}
+
+// Exists returns true if the container exists.
+func (c *vmDockerClient) Exists(name string) (bool, error) {
+	_, err := c.client.InspectContainerWithOptions(docker.InspectContainerOptions{ID: name})
+	if _, ok := err.(*docker.NoSuchContainer); ok {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("failed to get container %s: %v", name, err)
+	}
+	return true, nil
+}
+
+// RemoveApp kills and removes the container, like docker rm --force.
+func (c *vmDockerClient) RemoveApp(name string) error {
+	if err := c.client.RemoveContainer(docker.RemoveContainerOptions{ID: name, Force: true}); err != nil {
+		return fmt.Errorf("failed to remove container %s: %v", name, err)
+	}
+	return nil
+}
+
+// Close is a no-op, the docker connections are closed with the SSH client.
+func (c *vmDockerClient) Close() error {
+	return nil
+}
@@ -0,0 +1,324 @@
+package cmd
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/containernetworking/cni/libcni"
+	"github.com/containernetworking/cni/pkg/invoke"
+	"github.com/containernetworking/cni/pkg/types"
+	"github.com/containernetworking/cni/pkg/types/current"
+	"github.com/containernetworking/cni/pkg/version"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// cniPluginsVersion is the version of the CNI plugins installed in the
+	// containerd base images.
+	cniPluginsVersion = "v0.8.7"
+	// vmCNIBinDir is the directory of the CNI plugins in the VM.
+	vmCNIBinDir = "/opt/cni/bin"
+	// cniCacheDir is the host directory of the CNI results cache, with a
+	// directory per VM.
+	cniCacheDir = "/var/lib/ignite-cntr/cni"
+
+	// vmNetworkName is the name of the bridge network of the app containers
+	// in the VM.
+	vmNetworkName = "ignite-cntr"
+	// vmNetworkBridge is the bridge interface of the network in the VM.
+	vmNetworkBridge = "cntr0"
+	// vmNetworkSubnet is the subnet of the network, the bridge is the
+	// gateway.
+	vmNetworkSubnet = "10.88.0.0/16"
+	// vmNetworkIfName is the network interface of the app containers.
+	vmNetworkIfName = "eth0"
+)
+
+// vmNetworkConfList is the CNI network of the app containers: a bridge with
+// NAT to the VM network, and the published ports mapped by the portmap plugin.
+var vmNetworkConfList = fmt.Sprintf(`{
+	"cniVersion": "0.4.0",
+	"name": %q,
+	"plugins": [
+		{
+			"type": "bridge",
+			"bridge": %q,
+			"isGateway": true,
+			"ipMasq": true,
+			"hairpinMode": true,
+			"ipam": {
+				"type": "host-local",
+				"ranges": [[{"subnet": %q}]],
+				"routes": [{"dst": "0.0.0.0/0"}]
+			}
+		},
+		{
+			"type": "portmap",
+			"capabilities": {"portMappings": true},
+			"snat": true
+		}
+	]
+}`, vmNetworkName, vmNetworkBridge, vmNetworkSubnet)
+
+// vmLoopbackConf brings up the loopback interface of the app containers.
+const vmLoopbackConf = `{"cniVersion": "0.4.0", "name": "ignite-cntr-loopback", "type": "loopback"}`
+
+// vmNetwork connects the app containers to the bridge network of a VM. The CNI
+// plugins are run in the VM over SSH, the results are cached on the host.
+type vmNetwork struct {
+	exec     invoke.Exec
+	cni      *libcni.CNIConfig
+	network  *libcni.NetworkConfigList
+	loopback *libcni.NetworkConfig
+}
+
+// newVMNetwork returns the network of the VM with the given ID, reached
+// through the SSH connection to the VM.
+func newVMNetwork(sshClient *gossh.Client, vmID string) (*vmNetwork, error) {
+	return newVMNetworkWithExec(&sshPluginExec{client: sshClient}, filepath.Join(cniCacheDir, vmID))
+}
+
+// newVMNetworkWithExec returns the network running the CNI plugins with exec,
+// caching the results in cacheDir.
+func newVMNetworkWithExec(exec invoke.Exec, cacheDir string) (*vmNetwork, error) {
+	network, err := libcni.ConfListFromBytes([]byte(vmNetworkConfList))
+	if err != nil {
+		return nil, err
+	}
+	loopback, err := libcni.ConfFromBytes([]byte(vmLoopbackConf))
+	if err != nil {
+		return nil, err
+	}
+	return &vmNetwork{
+		exec:     exec,
+		cni:      libcni.NewCNIConfigWithCacheDir([]string{vmCNIBinDir}, cacheDir, exec),
+		network:  network,
+		loopback: loopback,
+	}, nil
+}
+
+// vmNetworkPlugins are the CNI plugins of the network.
+var vmNetworkPlugins = []string{"bridge", "host-local", "portmap", "loopback"}
+
+// Available returns true if the CNI plugins of the network are installed in
+// the VM. The VM images built from base images older than the CNI support have
+// no plugins.
+func (n *vmNetwork) Available() (bool, error) {
+	for _, plugin := range vmNetworkPlugins {
+		if _, err := n.exec.FindInPath(plugin, n.cni.Path); err != nil {
+			if _, ok := err.(*pluginNotFoundError); ok {
+				return false, nil
+			}
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// Setup connects a container, in the network namespace of the process pid, to
+// the network and publishes its ports. It returns the IP of the container.
+func (n *vmNetwork) Setup(ctx context.Context, id string, pid uint32, ports []appPort) (string, error) {
+	if _, err := n.cni.AddNetwork(ctx, n.loopback, n.loopbackRuntimeConf(id, pid)); err != nil {
+		return "", fmt.Errorf("failed to set up the loopback of container %s: %v", id, err)
+	}
+	result, err := n.cni.AddNetworkList(ctx, n.network, n.runtimeConf(id, pid, ports))
+	if err != nil {
+		return "", fmt.Errorf("failed to set up the network of container %s: %v", id, err)
+	}
+
+	res, err := current.NewResultFromResult(result)
+	if err != nil {
+		return "", err
+	}
+	if len(res.IPs) == 0 {
+		return "", fmt.Errorf("no IP assigned to container %s", id)
+	}
+	return res.IPs[0].Address.IP.String(), nil
+}
+
+// Remove disconnects a container from the network, releasing its IP and ports.
+// The process pid may be gone, the IP is released anyway. The ports must be the
+// published ports of the container: the CNI DEL doesn't use the cached ones,
+// and the portmap plugin only removes the mappings of the given ports.
+func (n *vmNetwork) Remove(ctx context.Context, id string, pid uint32, ports []appPort) error {
+	if err := n.cni.DelNetworkList(ctx, n.network, n.runtimeConf(id, pid, ports)); err != nil {
+		return fmt.Errorf("failed to remove the network of container %s: %v", id, err)
+	}
+	return nil
+}
+
+// runtimeConf returns the CNI runtime config of a container.
+func (n *vmNetwork) runtimeConf(id string, pid uint32, ports []appPort) *libcni.RuntimeConf {
+	// The portmap plugin capability arguments.
+	type portMapping struct {
+		HostPort      uint16 `json:"hostPort"`
+		ContainerPort uint16 `json:"containerPort"`
+		Protocol      string `json:"protocol"`
+	}
+	mappings := []portMapping{}
+	for _, p := range ports {
+		mappings = append(mappings, portMapping{HostPort: p.VMPort, ContainerPort: p.ContainerPort, Protocol: p.Protocol})
+	}
+	return &libcni.RuntimeConf{
+		ContainerID:    id,
+		NetNS:          netNSPath(pid),
+		IfName:         vmNetworkIfName,
+		CapabilityArgs: map[string]interface{}{"portMappings": mappings},
+	}
+}
+
+// loopbackRuntimeConf returns the CNI runtime config of the loopback of a
+// container.
+func (n *vmNetwork) loopbackRuntimeConf(id string, pid uint32) *libcni.RuntimeConf {
+	return &libcni.RuntimeConf{ContainerID: id, NetNS: netNSPath(pid), IfName: "lo"}
+}
+
+// netNSPath returns the path of the network namespace of a process. Empty for
+// no process, the CNI plugins skip the namespace cleanup.
+func netNSPath(pid uint32) string {
+	if pid == 0 {
+		return ""
+	}
+	return fmt.Sprintf("/proc/%d/ns/net", pid)
+}
+
+// sshPluginExec runs the CNI plugins in a VM over SSH.
+type sshPluginExec struct {
+	client *gossh.Client
+}
+
+// ExecPlugin runs a plugin with the CNI environment variables. Like the local
+// CNI exec, the error result printed by a failed plugin is returned as error.
+func (e *sshPluginExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	// Only pass the CNI variables, the rest of the environment is the host's.
+	cmd := []string{"env"}
+	for _, env := range environ {
+		if strings.HasPrefix(env, "CNI_") {
+			cmd = append(cmd, shellQuote(env))
+		}
+	}
+	cmd = append(cmd, shellQuote(pluginPath))
+
+	stdout, stderr, err := e.run(strings.Join(cmd, " "), stdinData)
+	if err == nil {
+		return stdout, nil
+	}
+	pluginErr := &types.Error{}
+	if len(stdout) > 0 && json.Unmarshal(stdout, pluginErr) == nil {
+		return nil, pluginErr
+	}
+	if len(stderr) > 0 {
+		return nil, fmt.Errorf("%s failed: %v: %s", path.Base(pluginPath), err, strings.TrimSpace(string(stderr)))
+	}
+	return nil, fmt.Errorf("%s failed: %v", path.Base(pluginPath), err)
+}
+
+// FindInPath returns the path of a plugin in the plugin directories of the VM.
+func (e *sshPluginExec) FindInPath(plugin string, paths []string) (string, error) {
+	for _, dir := range paths {
+		pluginPath := path.Join(dir, plugin)
+		_, _, err := e.run("test -x "+shellQuote(pluginPath), nil)
+		if err == nil {
+			return pluginPath, nil
+		}
+		// test exits with 1 if the file isn't executable, other errors are
+		// SSH errors.
+		if exitErr, ok := err.(*gossh.ExitError); !ok || exitErr.ExitStatus() != 1 {
+			return "", fmt.Errorf("failed to find plugin %q in the VM: %v", plugin, err)
+		}
+	}
+	return "", &pluginNotFoundError{plugin: plugin, paths: paths}
+}
+
+// pluginNotFoundError is the error of a CNI plugin missing in the VM.
+type pluginNotFoundError struct {
+	plugin string
+	paths  []string
+}
+
+func (e *pluginNotFoundError) Error() string {
+	return fmt.Sprintf("failed to find plugin %q in the VM path %s, the VM base image has no CNI plugins", e.plugin, strings.Join(e.paths, ":"))
+}
+
+// Decode decodes the version info of a plugin.
+func (e *sshPluginExec) Decode(jsonBytes []byte) (version.PluginInfo, error) {
+	return (&version.PluginDecoder{}).Decode(jsonBytes)
+}
+
+// run runs a shell command in the VM with the given stdin, and returns its
+// stdout and stderr.
+func (e *sshPluginExec) run(cmd string, stdin []byte) ([]byte, []byte, error) {
+	session, err := e.client.NewSession()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer session.Close()
+
+	var stdout, stderr bytes.Buffer
+	session.Stdin = bytes.NewReader(stdin)
+	session.Stdout = &stdout
+	session.Stderr = &stderr
+	err = session.Run(cmd)
+	return stdout.Bytes(), stderr.Bytes(), err
+}
+
+// shellQuote quotes a string for a POSIX shell.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// portsLabelValue returns the value of the label recording the published ports
+// of a container.
+func portsLabelValue(ports []appPort) (string, error) {
+	data, err := json.Marshal(ports)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
+
+// portsFromLabels returns the published ports of a container from its labels.
+// No ports are returned for the containers without the ports label.
+func portsFromLabels(labels map[string]string) ([]appPort, error) {
+	value := labels[portsLabel]
+	if value == "" {
+		return nil, nil
+	}
+	var ports []appPort
+	if err := json.Unmarshal([]byte(value), &ports); err != nil {
+		return nil, fmt.Errorf("invalid %s label %q: %v", portsLabel, value, err)
+	}
+	return ports, nil
+}
+
+// parseAppPort parses a published port in <vm-port>:<container-port>[/tcp|udp]
+// format. The protocol defaults to tcp.
+func parseAppPort(s string) (appPort, error) {
+	spec, protocol := s, "tcp"
+	if i := strings.LastIndex(s, "/"); i >= 0 {
+		spec, protocol = s[:i], strings.ToLower(s[i+1:])
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return appPort{}, fmt.Errorf("invalid port %q, unknown protocol %q, want tcp or udp", s, protocol)
+	}
+
+	parts := strings.Split(spec, ":")
+	if len(parts) != 2 {
+		return appPort{}, fmt.Errorf("invalid port %q, want <vm-port>:<container-port>[/tcp|udp]", s)
+	}
+	var ports [2]uint16
+	for i, part := range parts {
+		port, err := strconv.ParseUint(part, 10, 16)
+		if err != nil || port == 0 {
+			return appPort{}, fmt.Errorf("invalid port %q, %q is not a port number", s, part)
+		}
+		ports[i] = uint16(port)
+	}
+	return appPort{VMPort: ports[0], ContainerPort: ports[1], Protocol: protocol}, nil
+}
@@ -0,0 +1,146 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/containernetworking/cni/pkg/version"
+)
+
+func TestParseAppPort(t *testing.T) {
+	tests := []struct {
+		port    string
+		want    appPort
+		wantErr bool
+	}{
+		{port: "8080:80", want: appPort{VMPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		{port: "8080:80/tcp", want: appPort{VMPort: 8080, ContainerPort: 80, Protocol: "tcp"}},
+		{port: "53:53/udp", want: appPort{VMPort: 53, ContainerPort: 53, Protocol: "udp"}},
+		{port: "53:53/UDP", want: appPort{VMPort: 53, ContainerPort: 53, Protocol: "udp"}},
+		{port: "65535:1", want: appPort{VMPort: 65535, ContainerPort: 1, Protocol: "tcp"}},
+		{port: "8080:80/sctp", wantErr: true},
+		{port: "8080:80/", wantErr: true},
+		{port: "0:80", wantErr: true},
+		{port: "8080:0", wantErr: true},
+		{port: "65536:80", wantErr: true},
+		{port: "-1:80", wantErr: true},
+		{port: "http:80", wantErr: true},
+		{port: "80", wantErr: true},
+		{port: "127.0.0.1:8080:80", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.port, func(t *testing.T) {
+			got, err := parseAppPort(tt.port)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("got error %v, want error %t", err, tt.wantErr)
+			}
+			if !tt.wantErr && got != tt.want {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// fakePluginExec records the CNI plugin calls, the plugins succeed with no
+// output.
+type fakePluginExec struct {
+	// stdin is the stdin of the calls keyed by "<command> <plugin>".
+	stdin map[string][]byte
+}
+
+func (e *fakePluginExec) ExecPlugin(ctx context.Context, pluginPath string, stdinData []byte, environ []string) ([]byte, error) {
+	var command string
+	for _, env := range environ {
+		if strings.HasPrefix(env, "CNI_COMMAND=") {
+			command = strings.TrimPrefix(env, "CNI_COMMAND=")
+		}
+	}
+	e.stdin[command+" "+path.Base(pluginPath)] = stdinData
+	return nil, nil
+}
+
+func (e *fakePluginExec) FindInPath(plugin string, paths []string) (string, error) {
+	return path.Join(paths[0], plugin), nil
+}
+
+func (e *fakePluginExec) Decode(jsonBytes []byte) (version.PluginInfo, error) {
+	return (&version.PluginDecoder{}).Decode(jsonBytes)
+}
+
+func TestVMNetworkRemovePorts(t *testing.T) {
+	cacheDir, err := ioutil.TempDir("", "cni-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cacheDir)
+
+	ports := []appPort{
+		{VMPort: 8080, ContainerPort: 80, Protocol: "tcp"},
+		{VMPort: 53, ContainerPort: 53, Protocol: "udp"},
+	}
+	tests := []struct {
+		name   string
+		labels map[string]string
+		want   []appPort
+	}{
+		{name: "no ports label"},
+		{name: "no ports", labels: map[string]string{portsLabel: "[]"}},
+		{name: "ports", labels: map[string]string{portsLabel: mustPortsLabelValue(t, ports)}, want: ports},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			exec := &fakePluginExec{stdin: map[string][]byte{}}
+			network, err := newVMNetworkWithExec(exec, cacheDir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			labelPorts, err := portsFromLabels(tt.labels)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := network.Remove(context.Background(), "app", 0, labelPorts); err != nil {
+				t.Fatal(err)
+			}
+
+			// The portmap plugin gets the port mappings in the runtime
+			// config.
+			stdin, ok := exec.stdin["DEL portmap"]
+			if !ok {
+				t.Fatal("portmap DEL not called")
+			}
+			var conf struct {
+				RuntimeConfig struct {
+					PortMappings []struct {
+						HostPort      uint16 `json:"hostPort"`
+						ContainerPort uint16 `json:"containerPort"`
+						Protocol      string `json:"protocol"`
+					} `json:"portMappings"`
+				} `json:"runtimeConfig"`
+			}
+			if err := json.Unmarshal(stdin, &conf); err != nil {
+				t.Fatal(err)
+			}
+			var got []appPort
+			for _, m := range conf.RuntimeConfig.PortMappings {
+				got = append(got, appPort{VMPort: m.HostPort, ContainerPort: m.ContainerPort, Protocol: m.Protocol})
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got port mappings %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func mustPortsLabelValue(t *testing.T, ports []appPort) string {
+	value, err := portsLabelValue(ports)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return value
+}
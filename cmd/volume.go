@@ -0,0 +1,573 @@
+package cmd
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"syscall"
+	"text/tabwriter"
+	"time"
+
+	"github.com/docker/go-units"
+	"github.com/spf13/cobra"
+	api "github.com/weaveworks/ignite/pkg/apis/ignite"
+	"github.com/weaveworks/ignite/pkg/providers"
+	"github.com/weaveworks/ignite/pkg/runtime"
+	gossh "golang.org/x/crypto/ssh"
+)
+
+const (
+	// volumeStoreDir is the host directory of the volumes, with a directory
+	// per volume.
+	volumeStoreDir = "/var/lib/ignite-cntr/volumes"
+	// volumeDiskFile is the disk image file of a volume.
+	volumeDiskFile = "disk.img"
+	// volumeMetadataFile is the metadata file of a volume.
+	volumeMetadataFile = "volume.json"
+	// vmVolumeDir is the directory of the VMs where the attached volumes are
+	// mounted, at <vmVolumeDir>/<volume-name>.
+	vmVolumeDir = "/mnt/ignite-cntr/volumes"
+
+	defaultVolumeSize = "1GB"
+)
+
+var (
+	// volumeSize is the size of the created volume.
+	volumeSize string
+
+	// volumeNameRegexp matches the valid volume names.
+	volumeNameRegexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_.-]*$`)
+)
+
+// volume is a persistent volume backed by an ext4 disk image on the host. It's
+// attached to the VMs as an ignite block device volume, through a loop device.
+type volume struct {
+	// Name is the name of the volume.
+	Name string `json:"name"`
+	// Size is the size of the disk image in bytes.
+	Size int64 `json:"size"`
+	// Created is the creation time of the volume.
+	Created time.Time `json:"created"`
+}
+
+// volumeCmd represents the volume command
+var volumeCmd = &cobra.Command{
+	Use:   "volume",
+	Short: "Manage persistent volumes.",
+	Long: `Manage persistent volumes for the application containers. A volume is a
+disk image on the host, attached to a VM as an ignite block device volume and
+mounted into the containers with run --volume <volume-name>:<container-path>.
+The data of a volume survives the VM removal.`,
+}
+
+// volumeCreateCmd represents the volume create command
+var volumeCreateCmd = &cobra.Command{
+	Use:   "create <volume-name>",
+	Short: "Create a volume.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 1 {
+			return errors.New("require one volume name argument")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVolumeCreate(args[0], volumeSize); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+// volumeLsCmd represents the volume ls command
+var volumeLsCmd = &cobra.Command{
+	Use:   "ls",
+	Short: "List the volumes.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 0 {
+			return errors.New("require no arguments")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVolumeLs(); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+// volumeRmCmd represents the volume rm command
+var volumeRmCmd = &cobra.Command{
+	Use:   "rm <volume-name>...",
+	Short: "Remove volumes and their data.",
+	Long: `Remove volumes and their data. The volumes attached to a VM can't be
+removed, detach them first.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) == 0 {
+			return errors.New("require at least one volume name argument")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVolumeRm(args); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+// volumeAttachCmd represents the volume attach command
+var volumeAttachCmd = &cobra.Command{
+	Use:   "attach <volume-name> <ignite-vm-name>",
+	Short: "Attach a volume to a stopped VM.",
+	Long: `Attach a volume to a stopped ignite VM. The volume is passed to the VM as a
+block device when the VM starts, and mounted in the VM at
+` + vmVolumeDir + `/<volume-name> by run, when a container mounts it. A volume
+can only be attached to one VM. Attach the volumes again after a host reboot,
+to set up their loop devices.`,
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("require volume name and ignite VM name arguments")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVolumeAttach(args[0], args[1]); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+// volumeDetachCmd represents the volume detach command
+var volumeDetachCmd = &cobra.Command{
+	Use:   "detach <volume-name> <ignite-vm-name>",
+	Short: "Detach a volume from a stopped VM.",
+	Args: func(cmd *cobra.Command, args []string) error {
+		if len(args) != 2 {
+			return errors.New("require volume name and ignite VM name arguments")
+		}
+		return nil
+	},
+	Run: func(cmd *cobra.Command, args []string) {
+		if err := runVolumeDetach(args[0], args[1]); err != nil {
+			fmt.Printf("error: %v\n", err)
+		}
+	},
+}
+
+func runVolumeCreate(name, size string) error {
+	if syscall.Getuid() != 0 {
+		return fmt.Errorf("this command needs to be run as root")
+	}
+	if err := validateVolumeName(name); err != nil {
+		return err
+	}
+	sizeBytes, err := units.RAMInBytes(size)
+	if err != nil {
+		return fmt.Errorf("invalid volume size %q: %v", size, err)
+	}
+
+	v, err := createVolume(name, sizeBytes)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Created volume %s (%s)\n", v.Name, units.BytesSize(float64(v.Size)))
+	return nil
+}
+
+func runVolumeLs() error {
+	volumes, err := listVolumes()
+	if err != nil {
+		return err
+	}
+
+	// The VMs are only listed if ignite is usable.
+	var vms []*api.VM
+	if syscall.Getuid() == 0 {
+		if err := initIgniteProviders(runtime.RuntimeDocker); err != nil {
+			return err
+		}
+		if vms, err = providers.Client.VMs().List(); err != nil {
+			return fmt.Errorf("failed to list VMs: %v", err)
+		}
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tSIZE\tDEVICE\tVMS\tCREATED")
+	for _, v := range volumes {
+		device, err := v.loopDevice()
+		if err != nil {
+			return err
+		}
+		if device == "" {
+			device = "-"
+		}
+		vmNames := "-"
+		if names := vmsWithVolume(vms, v.Name); len(names) > 0 {
+			vmNames = strings.Join(names, ",")
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", v.Name, units.BytesSize(float64(v.Size)), device, vmNames, v.Created.Format(time.RFC3339))
+	}
+	return w.Flush()
+}
+
+func runVolumeRm(names []string) error {
+	if syscall.Getuid() != 0 {
+		return fmt.Errorf("this command needs to be run as root")
+	}
+	if err := initIgniteProviders(runtime.RuntimeDocker); err != nil {
+		return err
+	}
+	vms, err := providers.Client.VMs().List()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %v", err)
+	}
+
+	for _, name := range names {
+		v, err := getVolume(name)
+		if err != nil {
+			return err
+		}
+		if vmNames := vmsWithVolume(vms, v.Name); len(vmNames) > 0 {
+			return fmt.Errorf("volume %q is attached to VM(s) %s, detach it first", v.Name, strings.Join(vmNames, ", "))
+		}
+		if err := v.remove(); err != nil {
+			return err
+		}
+		fmt.Printf("Removed volume %s\n", v.Name)
+	}
+	return nil
+}
+
+func runVolumeAttach(name, vmName string) error {
+	if syscall.Getuid() != 0 {
+		return fmt.Errorf("this command needs to be run as root")
+	}
+	v, err := getVolume(name)
+	if err != nil {
+		return err
+	}
+	if err := initIgniteProviders(runtime.RuntimeDocker); err != nil {
+		return err
+	}
+	iclient := providers.Client.VMs()
+	vm, err := getVMByName(iclient, vmName)
+	if err != nil {
+		return err
+	}
+	// ignite attaches the volumes when the VM starts.
+	if vm.Running() {
+		return fmt.Errorf("VM %q is running, stop it to attach volumes", vm.Name)
+	}
+	// Two VMs mounting the same filesystem would corrupt it.
+	vms, err := iclient.List()
+	if err != nil {
+		return fmt.Errorf("failed to list VMs: %v", err)
+	}
+	for _, name := range vmsWithVolume(vms, v.Name) {
+		if name != vm.Name {
+			return fmt.Errorf("volume %q is already attached to VM %q, detach it first", v.Name, name)
+		}
+	}
+
+	device, err := v.ensureLoopDevice()
+	if err != nil {
+		return err
+	}
+
+	// Replace a previous attachment, its loop device may be gone.
+	detachVolume(vm, v.Name)
+	vm.Spec.Storage.Volumes = append(vm.Spec.Storage.Volumes, api.Volume{
+		Name:        v.Name,
+		BlockDevice: &api.BlockDeviceVolume{Path: device},
+	})
+	vm.Spec.Storage.VolumeMounts = append(vm.Spec.Storage.VolumeMounts, api.VolumeMount{
+		Name:      v.Name,
+		MountPath: vmVolumePath(v.Name),
+	})
+	if err := iclient.Set(vm); err != nil {
+		return fmt.Errorf("failed to update VM %q: %v", vm.Name, err)
+	}
+	fmt.Printf("Attached volume %s (%s) to VM %s\n", v.Name, device, vm.Name)
+	return nil
+}
+
+func runVolumeDetach(name, vmName string) error {
+	if syscall.Getuid() != 0 {
+		return fmt.Errorf("this command needs to be run as root")
+	}
+	if err := initIgniteProviders(runtime.RuntimeDocker); err != nil {
+		return err
+	}
+	iclient := providers.Client.VMs()
+	vm, err := getVMByName(iclient, vmName)
+	if err != nil {
+		return err
+	}
+	if vm.Running() {
+		return fmt.Errorf("VM %q is running, stop it to detach volumes", vm.Name)
+	}
+
+	if !detachVolume(vm, name) {
+		return fmt.Errorf("volume %q is not attached to VM %q", name, vm.Name)
+	}
+	if err := iclient.Set(vm); err != nil {
+		return fmt.Errorf("failed to update VM %q: %v", vm.Name, err)
+	}
+	fmt.Printf("Detached volume %s from VM %s\n", name, vm.Name)
+	return nil
+}
+
+// detachVolume removes a volume and its mounts from the storage of a VM. It
+// returns false if the volume isn't attached to the VM.
+func detachVolume(vm *api.VM, name string) bool {
+	found := false
+	var volumes []api.Volume
+	for _, v := range vm.Spec.Storage.Volumes {
+		if v.Name == name {
+			found = true
+			continue
+		}
+		volumes = append(volumes, v)
+	}
+	var mounts []api.VolumeMount
+	for _, m := range vm.Spec.Storage.VolumeMounts {
+		if m.Name != name {
+			mounts = append(mounts, m)
+		}
+	}
+	vm.Spec.Storage.Volumes = volumes
+	vm.Spec.Storage.VolumeMounts = mounts
+	return found
+}
+
+// vmsWithVolume returns the names of the VMs a volume is attached to.
+func vmsWithVolume(vms []*api.VM, name string) []string {
+	var names []string
+	for _, vm := range vms {
+		for _, v := range vm.Spec.Storage.Volumes {
+			if v.Name == name && v.BlockDevice != nil {
+				names = append(names, vm.Name)
+				break
+			}
+		}
+	}
+	return names
+}
+
+// vmVolumeMountPath returns the path in a VM where a volume is mounted, empty
+// if the volume isn't attached to the VM.
+func vmVolumeMountPath(vm *api.VM, name string) string {
+	for _, m := range vm.Spec.Storage.VolumeMounts {
+		if m.Name == name {
+			return m.MountPath
+		}
+	}
+	return ""
+}
+
+// vmVolumePath returns the path in the VMs where a volume is mounted.
+func vmVolumePath(name string) string {
+	return path.Join(vmVolumeDir, name)
+}
+
+// volumeDir returns the directory of a volume.
+func volumeDir(name string) string {
+	return filepath.Join(volumeStoreDir, name)
+}
+
+// diskPath returns the path of the disk image of the volume.
+func (v *volume) diskPath() string {
+	return filepath.Join(volumeDir(v.Name), volumeDiskFile)
+}
+
+// createVolume creates a volume with an ext4 filesystem of the given size.
+func createVolume(name string, size int64) (*volume, error) {
+	dir := volumeDir(name)
+	if err := os.MkdirAll(volumeStoreDir, 0700); err != nil {
+		return nil, err
+	}
+	if err := os.Mkdir(dir, 0700); os.IsExist(err) {
+		return nil, fmt.Errorf("volume %q already exists", name)
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to create volume %q: %v", name, err)
+	}
+
+	v := &volume{Name: name, Size: size, Created: time.Now().UTC()}
+	if err := v.create(); err != nil {
+		os.RemoveAll(dir)
+		return nil, fmt.Errorf("failed to create volume %q: %v", name, err)
+	}
+	return v, nil
+}
+
+// create creates the sparse disk image and the metadata of the volume.
+func (v *volume) create() error {
+	disk, err := os.OpenFile(v.diskPath(), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	err = disk.Truncate(v.Size)
+	if closeErr := disk.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+
+	if out, err := exec.Command("mkfs.ext4", "-q", "-F", "-L", v.Name, v.diskPath()).CombinedOutput(); err != nil {
+		return fmt.Errorf("mkfs.ext4 failed: %v: %s", err, strings.TrimSpace(string(out)))
+	}
+
+	metadata, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filepath.Join(volumeDir(v.Name), volumeMetadataFile), metadata, 0600)
+}
+
+// validateVolumeName checks if a volume name is valid. The names are used in
+// the host paths of the volumes.
+func validateVolumeName(name string) error {
+	if !volumeNameRegexp.MatchString(name) {
+		return fmt.Errorf("invalid volume name %q, want lowercase letters, digits and _.- only", name)
+	}
+	return nil
+}
+
+// getVolume returns an existing volume.
+func getVolume(name string) (*volume, error) {
+	if err := validateVolumeName(name); err != nil {
+		return nil, err
+	}
+	metadata, err := ioutil.ReadFile(filepath.Join(volumeDir(name), volumeMetadataFile))
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("volume %q not found", name)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read volume %q: %v", name, err)
+	}
+	v := &volume{}
+	if err := json.Unmarshal(metadata, v); err != nil {
+		return nil, fmt.Errorf("invalid metadata of volume %q: %v", name, err)
+	}
+	return v, nil
+}
+
+// listVolumes returns the volumes sorted by name.
+func listVolumes() ([]*volume, error) {
+	entries, err := ioutil.ReadDir(volumeStoreDir)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to list volumes: %v", err)
+	}
+
+	var volumes []*volume
+	for _, entry := range entries {
+		if !entry.IsDir() || validateVolumeName(entry.Name()) != nil {
+			continue
+		}
+		v, err := getVolume(entry.Name())
+		if err != nil {
+			return nil, err
+		}
+		volumes = append(volumes, v)
+	}
+	sort.Slice(volumes, func(i, j int) bool {
+		return volumes[i].Name < volumes[j].Name
+	})
+	return volumes, nil
+}
+
+// remove detaches the loop device of the volume and removes its data.
+func (v *volume) remove() error {
+	device, err := v.loopDevice()
+	if err != nil {
+		return err
+	}
+	if device != "" {
+		if out, err := exec.Command("losetup", "--detach", device).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to detach loop device %s of volume %q: %v: %s", device, v.Name, err, strings.TrimSpace(string(out)))
+		}
+	}
+	if err := os.RemoveAll(volumeDir(v.Name)); err != nil {
+		return fmt.Errorf("failed to remove volume %q: %v", v.Name, err)
+	}
+	return nil
+}
+
+// loopDevice returns the loop device of the disk image of the volume, empty if
+// it has none.
+func (v *volume) loopDevice() (string, error) {
+	// The output lines are: /dev/loop0: []: (/path/to/disk.img)
+	out, err := exec.Command("losetup", "--associated", v.diskPath()).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to get the loop device of volume %q: %v: %s", v.Name, err, strings.TrimSpace(string(out)))
+	}
+	line := strings.SplitN(strings.TrimSpace(string(out)), "\n", 2)[0]
+	if i := strings.Index(line, ":"); i > 0 {
+		return line[:i], nil
+	}
+	return "", nil
+}
+
+// ensureLoopDevice returns the loop device of the disk image of the volume,
+// setting up one if needed.
+func (v *volume) ensureLoopDevice() (string, error) {
+	device, err := v.loopDevice()
+	if err != nil || device != "" {
+		return device, err
+	}
+	out, err := exec.Command("losetup", "--find", "--show", v.diskPath()).CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("failed to set up the loop device of volume %q: %v: %s", v.Name, err, strings.TrimSpace(string(out)))
+	}
+	return strings.TrimSpace(string(out)), nil
+}
+
+// filesystemUUID returns the UUID of the filesystem of the volume.
+func (v *volume) filesystemUUID() (string, error) {
+	out, err := exec.Command("blkid", "--match-tag", "UUID", "--output", "value", v.diskPath()).CombinedOutput()
+	uuid := strings.TrimSpace(string(out))
+	if err != nil {
+		return "", fmt.Errorf("failed to get the filesystem UUID of volume %q: %v: %s", v.Name, err, uuid)
+	}
+	if uuid == "" {
+		return "", fmt.Errorf("volume %q has no filesystem UUID", v.Name)
+	}
+	return uuid, nil
+}
+
+// mountVolumeInVM mounts the filesystem of a volume in a VM at vmPath, by
+// UUID, unless a filesystem is already mounted there. ignite only writes the
+// VM fstab entries of the volumes when the VM is created, the volumes attached
+// to an existing VM aren't mounted at boot.
+func mountVolumeInVM(sshClient *gossh.Client, v *volume, vmPath string) error {
+	uuid, err := v.filesystemUUID()
+	if err != nil {
+		return err
+	}
+	script := fmt.Sprintf("mkdir -p %[1]s && { mountpoint -q %[1]s || mount UUID=%[2]s %[1]s; }", shellQuote(vmPath), shellQuote(uuid))
+	if err := runInVM(sshClient, script); err != nil {
+		return fmt.Errorf("failed to mount volume %q at %q in the VM: %v", v.Name, vmPath, err)
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(volumeCmd)
+	volumeCmd.AddCommand(volumeCreateCmd)
+	volumeCmd.AddCommand(volumeLsCmd)
+	volumeCmd.AddCommand(volumeRmCmd)
+	volumeCmd.AddCommand(volumeAttachCmd)
+	volumeCmd.AddCommand(volumeDetachCmd)
+
+	volumeCreateCmd.Flags().StringVar(&volumeSize, "size", defaultVolumeSize, "Size of the volume, e.g. 512MB or 10GB")
+}
@@ -3,15 +3,25 @@ module github.com/darkowlzz/ignite-cntr
 go 1.13
 
 require (
+	github.com/containerd/containerd v1.5.0-beta.4
+	github.com/containernetworking/cni v0.8.0
+	github.com/docker/go-units v0.4.0
 	github.com/fsouza/go-dockerclient v1.6.3
 	github.com/joho/godotenv v1.3.0
 	github.com/mitchellh/go-homedir v1.1.0
 	github.com/moby/sys/mount v0.2.0 // indirect
+	github.com/opencontainers/go-digest v1.0.0
+	github.com/opencontainers/image-spec v1.0.1
+	github.com/opencontainers/runtime-spec v1.0.3-0.20200929063507-e6143ca7d51d
+	github.com/pkg/sftp v1.11.0
 	github.com/spf13/cobra v1.0.0
 	github.com/spf13/viper v1.6.2
 	github.com/weaveworks/ignite v0.9.1-0.20210419164134-8b31ad7524bc
 	github.com/weaveworks/libgitops v0.0.0-20200611103311-2c871bbbbf0c
 	golang.org/x/crypto v0.0.0-20201002170205-7f63de1d35b0
+	golang.org/x/sync v0.0.0-20210220032951-036812b2e83c
+	google.golang.org/grpc v1.37.0
+	sigs.k8s.io/yaml v1.2.0
 )
 
 replace github.com/docker/distribution => github.com/docker/distribution v0.0.0-20190711223531-1fb7fffdb266